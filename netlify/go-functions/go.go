@@ -1,15 +1,39 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"container/list"
 	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
 	b64 "encoding/base64"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"hash"
 	"io"
 	"log"
+	"math"
+	mathrand "math/rand"
 	"net/http"
 	"net/url"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
@@ -74,14 +98,19 @@ const (
 
 // MakeStoreRequestOptions represents options for making a request to store.
 type MakeStoreRequestOptions struct {
-	Body        BlobInput         `json:"body,omitempty"`
-	Consistency *ConsistencyMode  `json:"consistency,omitempty"`
-	Headers     map[string]string `json:"headers,omitempty"`
-	Key         string            `json:"key,omitempty"`
-	Metadata    Metadata          `json:"metadata,omitempty"`
-	Method      HTTPMethod        `json:"method"`
-	Parameters  map[string]string `json:"parameters,omitempty"`
-	StoreName   string            `json:"storeName,omitempty"`
+	Body        BlobInput        `json:"body,omitempty"`
+	Consistency *ConsistencyMode `json:"consistency,omitempty"`
+	// Context, if set, is attached to the outgoing requests.
+	Context context.Context `json:"-"`
+	// ContentLength is the size of Body in bytes. Zero leaves it to net/http
+	// to detect the length.
+	ContentLength int64             `json:"contentLength,omitempty"`
+	Headers       map[string]string `json:"headers,omitempty"`
+	Key           string            `json:"key,omitempty"`
+	Metadata      Metadata          `json:"metadata,omitempty"`
+	Method        HTTPMethod        `json:"method"`
+	Parameters    map[string]string `json:"parameters,omitempty"`
+	StoreName     string            `json:"storeName,omitempty"`
 }
 
 // ClientOptions represents configuration options for the client.
@@ -104,6 +133,7 @@ type InternalClientOptions struct {
 // GetFinalRequestOptions represents the final options for a request.
 type GetFinalRequestOptions struct {
 	Consistency *ConsistencyMode  `json:"consistency,omitempty"`
+	Context     context.Context   `json:"-"`
 	Key         string            `json:"key,omitempty"`
 	Metadata    Metadata          `json:"metadata,omitempty"`
 	Method      HTTPMethod        `json:"method"`
@@ -156,18 +186,64 @@ func NewBlobsConsistencyError() *BlobsConsistencyError {
 	}
 }
 
+// BlobsPreconditionError is returned when a conditional request fails
+// because the blob has changed.
+type BlobsPreconditionError struct {
+	Key     string
+	Message string
+}
+
+func (e *BlobsPreconditionError) Error() string {
+	return e.Message
+}
+
+func NewBlobsPreconditionError(key string) *BlobsPreconditionError {
+	return &BlobsPreconditionError{
+		Key:     key,
+		Message: fmt.Sprintf("Netlify Blobs has rejected a conditional request because key %q has been modified", key),
+	}
+}
+
+func requestContext(ctx context.Context) context.Context {
+	if ctx == nil {
+		return context.Background()
+	}
+	return ctx
+}
+
 // Client represents the client to interact with the API.
 type Client struct {
-	APIURL          string
-	Consistency     ConsistencyMode
-	EdgeURL         string
-	Fetch           Fetcher
-	Region          string
+	APIURL string
+	// Audit, if set, is called after every PUT and DELETE request.
+	Audit       AuditHook
+	Consistency ConsistencyMode
+	EdgeURL     string
+	Fetch       Fetcher
+	Region      string
+	// RequestID identifies the invocation the client works for in audit
+	// events.
+	RequestID       string
 	SiteID          string
 	Token           string
 	UncachedEdgeURL string
 }
 
+// AuditEvent records one mutating request made through a Client.
+type AuditEvent struct {
+	Time      time.Time  `json:"time"`
+	Method    HTTPMethod `json:"method"`
+	Store     string     `json:"store"`
+	Key       string     `json:"key"`
+	ETag      string     `json:"etag,omitempty"`
+	Size      int64      `json:"size"`
+	Status    int        `json:"status,omitempty"`
+	RequestID string     `json:"request_id,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// AuditHook receives an AuditEvent for every PUT and DELETE request.
+type AuditHook func(event AuditEvent)
+
 func encodeMetadata(metadata Metadata) (string, error) {
 	meta, err := json.Marshal(metadata)
 	if err != nil {
@@ -183,6 +259,33 @@ func encodeMetadata(metadata Metadata) (string, error) {
 	return payload, nil
 }
 
+func decodeMetadata(header string) (Metadata, error) {
+	metadata := Metadata{}
+	if !strings.HasPrefix(header, BASE64_PREFIX) {
+		return metadata, nil
+	}
+
+	meta, err := b64.StdEncoding.DecodeString(strings.TrimPrefix(header, BASE64_PREFIX))
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(meta, &metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	return metadata, nil
+}
+
+func getMetadataFromResponse(res *http.Response) (Metadata, error) {
+	value := res.Header.Get(METADATA_HEADER_EXTERNAL)
+	if value == "" {
+		value = res.Header.Get(METADATA_HEADER_INTERNAL)
+	}
+	return decodeMetadata(value)
+}
+
 // GetFinalRequest prepares the final request options.
 func (c *Client) GetFinalRequest(options GetFinalRequestOptions) (map[string]string, string, error) {
 	Consistency := c.Consistency
@@ -194,11 +297,11 @@ func (c *Client) GetFinalRequest(options GetFinalRequestOptions) (map[string]str
 	urlPath := fmt.Sprintf("/%s", c.SiteID)
 
 	if options.StoreName != "" {
-		urlPath += fmt.Sprintf("/%s", options.StoreName)
+		urlPath += fmt.Sprintf("/%s", escapePath(options.StoreName))
 	}
 
 	if options.Key != "" {
-		urlPath += fmt.Sprintf("/%s", options.Key)
+		urlPath += fmt.Sprintf("/%s", escapePath(options.Key))
 	}
 
 	if c.EdgeURL != "" {
@@ -249,6 +352,8 @@ func (c *Client) GetFinalRequest(options GetFinalRequestOptions) (map[string]str
 			q.Add(key, value)
 		}
 
+		url.RawQuery = q.Encode()
+
 		return headers, url.String(), nil
 	}
 
@@ -301,7 +406,7 @@ func (c *Client) GetFinalRequest(options GetFinalRequestOptions) (map[string]str
 		return apiHeaders, url.String(), nil
 	}
 
-	req, err := http.NewRequest(string(options.Method), url.String(), nil)
+	req, err := http.NewRequestWithContext(requestContext(options.Context), string(options.Method), url.String(), nil)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -319,13 +424,13 @@ func (c *Client) GetFinalRequest(options GetFinalRequestOptions) (map[string]str
 
 	fmt.Printf("req1: %+v\n", req)
 
-	res, err := http.DefaultTransport.RoundTrip(req)
+	res, err := c.roundTrip(req)
 	fmt.Printf("res1: %+v\n", res)
 
 	if err != nil {
-		err := NewBlobsInternalError(res)
 		return nil, "", err
 	}
+	defer res.Body.Close()
 
 	if res.StatusCode != 200 {
 		err := NewBlobsInternalError(res)
@@ -357,11 +462,21 @@ func (c *Client) GetFinalRequest(options GetFinalRequestOptions) (map[string]str
 	return userHeaders, signedS3Response.URL, nil
 }
 
+// roundTrip sends a request through the client's Fetch function, falling
+// back to the default transport.
+func (c *Client) roundTrip(req *http.Request) (*http.Response, error) {
+	if c.Fetch != nil {
+		return c.Fetch(req.URL.String(), req)
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
 // MakeRequest performs a request to the store.
 func (c *Client) MakeRequest(options MakeStoreRequestOptions) (*http.Response, error) {
 
 	headers, url, err := c.GetFinalRequest(GetFinalRequestOptions{
 		Consistency: options.Consistency,
+		Context:     options.Context,
 		Key:         options.Key,
 		Metadata:    options.Metadata,
 		Method:      options.Method,
@@ -381,19 +496,44 @@ func (c *Client) MakeRequest(options MakeStoreRequestOptions) (*http.Response, e
 		headers["cache-control"] = "max-age=0, stale-while-revalidate=60"
 	}
 
-	req, err := http.NewRequest(string(options.Method), url, options.Body)
+	req, err := http.NewRequestWithContext(requestContext(options.Context), string(options.Method), url, options.Body)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if options.ContentLength > 0 {
+		req.ContentLength = options.ContentLength
+	}
+
 	for k, v := range headers {
 		req.Header.Add(k, v)
 	}
 
 	fmt.Printf("MakeRequest: url: %s\n", url)
 
-	return http.DefaultTransport.RoundTrip(req)
+	res, err := c.roundTrip(req)
+
+	if c.Audit != nil && (options.Method == HTTPMethodPut || options.Method == HTTPMethodDelete) {
+		event := AuditEvent{
+			Time:      time.Now(),
+			Method:    options.Method,
+			Store:     options.StoreName,
+			Key:       options.Key,
+			RequestID: c.RequestID,
+		}
+		if options.Method == HTTPMethodPut {
+			event.Size = req.ContentLength
+		}
+		if err != nil {
+			event.Error = err.Error()
+		} else {
+			event.ETag = res.Header.Get("etag")
+			event.Status = res.StatusCode
+		}
+		c.Audit(event)
+	}
 
+	return res, err
 }
 
 // BlobsConsistencyError represents an error related to blob consistency.
@@ -429,8 +569,63 @@ type NamedStoreOptions struct {
 
 // Store represents a store object in the system.
 type Store struct {
+	// Cache, if set, serves reads from memory and revalidates them by ETag.
+	Cache  *Cache
 	Client *Client
 	Name   string
+	// KeyEncoding, if set, encodes keys before the prefix is applied and
+	// decodes listed keys.
+	KeyEncoding KeyEncoding
+	// ValidateKey, if set, replaces the default key validation. It receives
+	// keys as they will be stored, with the encoding and prefix applied.
+	ValidateKey func(key string) error
+
+	// prefix is prepended to every key the store reads or writes and
+	// stripped from listed keys. It is only set by Sub, so code handed a
+	// view cannot widen it.
+	prefix string
+}
+
+// KeyEncoding reversibly maps arbitrary strings to valid keys. Encodings
+// must preserve prefixes, so that listing by an encoded prefix finds the
+// keys that start with it.
+type KeyEncoding interface {
+	Encode(key string) string
+	Decode(encoded string) (string, error)
+}
+
+// HexKeyEncoding stores every key as the hex encoding of its bytes, which
+// lets any string up to 300 bytes be used as a key. Slashes are encoded
+// too, so encoded keys are never listed as directories.
+type HexKeyEncoding struct{}
+
+func (HexKeyEncoding) Encode(key string) string {
+	return hex.EncodeToString([]byte(key))
+}
+
+func (HexKeyEncoding) Decode(encoded string) (string, error) {
+	decoded, err := hex.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	return string(decoded), nil
+}
+
+// escapePath percent-encodes each segment of a key or store name for use in
+// a URL path. Dot segments are encoded too, so they are not resolved away.
+func escapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		switch segment {
+		case ".":
+			segments[i] = "%2E"
+		case "..":
+			segments[i] = "%2E%2E"
+		default:
+			segments[i] = url.PathEscape(segment)
+		}
+	}
+	return strings.Join(segments, "/")
 }
 
 func validateStoreName(name string) error {
@@ -446,8 +641,11 @@ func validateStoreName(name string) error {
 	return nil
 }
 
-// NewStore creates a new store instance.
+// NewStore creates a new store instance. Names carrying the legacy
+// namespace prefix are mapped to the unprefixed store they refer to.
 func NewStore(storeName string, client Client) (*Store, error) {
+	storeName = strings.TrimPrefix(storeName, LEGACY_STORE_INTERNAL_PREFIX)
+
 	err := validateStoreName(storeName)
 	if err != nil {
 		return nil, err
@@ -458,21 +656,134 @@ func NewStore(storeName string, client Client) (*Store, error) {
 	}, nil
 }
 
-// Delete removes a key from the store.
+// Sub returns a view of the store in which every key is transparently
+// prefixed with prefix. Views nest, so Sub("a/").Sub("b/") reads and writes
+// keys under "a/b/".
+func (s *Store) Sub(prefix string) *Store {
+	sub := *s
+	sub.prefix = s.prefix + prefix
+	return &sub
+}
+
+// storedKey returns a key as it is sent to the API, with the encoding and
+// prefix applied.
+func (s *Store) storedKey(key string) string {
+	if s.KeyEncoding != nil {
+		key = s.KeyEncoding.Encode(key)
+	}
+	return s.prefix + key
+}
+
+// listedKey reverses storedKey for a key or directory from a listing.
+func (s *Store) listedKey(key string) (string, error) {
+	key = strings.TrimPrefix(key, s.prefix)
+	if s.KeyEncoding == nil {
+		return key, nil
+	}
+
+	decoded, err := s.KeyEncoding.Decode(key)
+	if err != nil {
+		return "", fmt.Errorf("decoding listed key %q: %w", key, err)
+	}
+	return decoded, nil
+}
+
+// checkKey validates a key as it will be stored.
+func (s *Store) checkKey(key string) error {
+	if key == "" {
+		return validateKey(key)
+	}
+	if s.ValidateKey != nil {
+		return s.ValidateKey(s.storedKey(key))
+	}
+	return validateKey(s.storedKey(key))
+}
+
+// Delete removes a key from the store. Deleting a key that does not exist
+// is not an error.
 func (s *Store) Delete(key string) error {
-	// Simulate deleting the key
+	return s.delete(context.Background(), key, "")
+}
+
+// delete removes a key. If etag is set, the key is only removed while its
+// ETag still matches, and a BlobsPreconditionError is returned otherwise.
+func (s *Store) delete(ctx context.Context, key string, etag string) error {
+	err := s.checkKey(key)
+	if err != nil {
+		return err
+	}
+
+	if s.Cache != nil {
+		defer s.Cache.Remove(s.cacheKey(key))
+	}
+
+	headers := map[string]string{}
+	if etag != "" {
+		headers["if-match"] = etag
+	}
+
+	res, err := s.Client.MakeRequest(MakeStoreRequestOptions{
+		Consistency: &s.Client.Consistency,
+		Context:     ctx,
+		Headers:     headers,
+		Key:         s.storedKey(key),
+		Method:      HTTPMethodDelete,
+		Parameters:  map[string]string{},
+		StoreName:   s.Name,
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == 412 {
+		return NewBlobsPreconditionError(key)
+	}
+
+	if res.StatusCode != 200 && res.StatusCode != 204 && res.StatusCode != 404 {
+		return NewBlobsInternalError(res)
+	}
+
 	return nil
 }
 
-// Get retrieves a value from the store.
-func (s *Store) Get(key string) (io.ReadCloser, error) {
+// get performs a GET or HEAD request for a key, returning a nil response
+// when the key does not exist or has expired.
+func (s *Store) get(ctx context.Context, key string, method HTTPMethod, headers map[string]string) (*http.Response, error) {
+	res, err := s.getIncludingExpired(ctx, key, method, headers)
+	if err != nil || res == nil || res.StatusCode == 304 {
+		return res, err
+	}
+
+	metadata, err := getMetadataFromResponse(res)
+	if err != nil {
+		res.Body.Close()
+		return nil, err
+	}
+
+	if isExpired(metadata, time.Now()) {
+		res.Body.Close()
+		return nil, nil
+	}
+
+	return res, nil
+}
+
+// getIncludingExpired is like get but also returns blobs past their expiry.
+func (s *Store) getIncludingExpired(ctx context.Context, key string, method HTTPMethod, headers map[string]string) (*http.Response, error) {
+	err := s.checkKey(key)
+	if err != nil {
+		return nil, err
+	}
+
 	res, err := s.Client.MakeRequest(MakeStoreRequestOptions{
 		Body:        nil,
 		Consistency: &s.Client.Consistency,
-		Headers:     map[string]string{},
-		Key:         key,
+		Context:     ctx,
+		Headers:     headers,
+		Key:         s.storedKey(key),
 		Metadata:    map[string]interface{}{},
-		Method:      HTTPMethodGet,
+		Method:      method,
 		Parameters:  map[string]string{},
 		StoreName:   s.Name,
 	})
@@ -482,152 +793,5510 @@ func (s *Store) Get(key string) (io.ReadCloser, error) {
 	}
 
 	if res.StatusCode == 404 {
+		res.Body.Close()
 		return nil, nil
 	}
 
-	if res.StatusCode != 200 {
+	if res.StatusCode == 412 {
+		res.Body.Close()
+		return nil, NewBlobsPreconditionError(key)
+	}
+
+	if res.StatusCode != 200 && res.StatusCode != 206 && res.StatusCode != 304 {
+		res.Body.Close()
 		return nil, NewBlobsInternalError(res)
 	}
 
-	return res.Body, nil
+	return res, nil
 }
 
-// ListOptions represents options for listing store items.
-type ListOptions struct {
-	Directories bool   `json:"directories,omitempty"`
-	Paginate    bool   `json:"paginate,omitempty"`
-	Prefix      string `json:"prefix,omitempty"`
+// Get retrieves a value from the store.
+func (s *Store) Get(key string) (io.ReadCloser, error) {
+	if s.Cache != nil {
+		entry, err := s.getCached(context.Background(), key)
+		if err != nil || entry == nil {
+			return nil, err
+		}
+		return entry.Data, nil
+	}
+
+	res, err := s.get(context.Background(), key, HTTPMethodGet, map[string]string{})
+	if err != nil || res == nil {
+		return nil, err
+	}
+
+	return res.Body, nil
 }
 
-// ListResult represents the result of a list operation.
-type ListResult struct {
-	Blobs       []ListResultBlob `json:"blobs"`
-	Directories []string         `json:"directories"`
+// GetWithMetadataResult represents a blob together with its ETag and metadata.
+type GetWithMetadataResult struct {
+	Data     io.ReadCloser
+	ETag     string
+	Metadata Metadata
+	// Size is the content length reported for the blob, or -1 if unknown.
+	Size int64
 }
 
-// List lists store items based on the options.
-func (s *Store) List(options *ListOptions) (*ListResult, error) {
-	// Simulate listing the result
-	return &ListResult{}, nil
+// GetWithMetadata retrieves a value from the store along with its ETag and
+// metadata. It returns nil if the key does not exist.
+func (s *Store) GetWithMetadata(key string) (*GetWithMetadataResult, error) {
+	return s.getWithMetadata(context.Background(), key)
 }
 
-func validateKey(key string) error {
-	if key == "" {
-		return fmt.Errorf("key must not be empty")
+// getWithMetadata is GetWithMetadata with a context for the requests.
+func (s *Store) getWithMetadata(ctx context.Context, key string) (*GetWithMetadataResult, error) {
+	if s.Cache != nil {
+		return s.getCached(ctx, key)
 	}
 
-	if strings.HasPrefix(key, "/") || strings.HasPrefix(key, "%2F") {
-		return fmt.Errorf("key must not start with forward slash (/)")
+	res, err := s.get(ctx, key, HTTPMethodGet, map[string]string{})
+	if err != nil || res == nil {
+		return nil, err
 	}
 
-	if len(key) > 600 {
-		return fmt.Errorf(
-			"key must be a sequence of Unicode characters whose UTF-8 encoding is at most 600 bytes long",
-		)
+	metadata, err := getMetadataFromResponse(res)
+	if err != nil {
+		res.Body.Close()
+		return nil, err
 	}
-	return nil
+
+	return &GetWithMetadataResult{
+		Data:     res.Body,
+		ETag:     res.Header.Get("etag"),
+		Metadata: metadata,
+		Size:     res.ContentLength,
+	}, nil
 }
 
-// Set stores data in the store.
-func (s *Store) Set(key string, data BlobInput, options *SetOptions) error {
+// GetMetadataResult represents the ETag and metadata of a blob.
+type GetMetadataResult struct {
+	ETag     string
+	Metadata Metadata
+	// Size is the content length reported for the blob, or -1 if unknown.
+	Size int64
+}
+
+// GetMetadata retrieves the ETag and metadata of a key without its value.
+// It returns nil if the key does not exist.
+func (s *Store) GetMetadata(key string) (*GetMetadataResult, error) {
+	res, err := s.get(context.Background(), key, HTTPMethodHead, map[string]string{})
+	if err != nil || res == nil {
+		return nil, err
+	}
+	res.Body.Close()
 
-	err := validateKey(key)
+	metadata, err := getMetadataFromResponse(res)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	res, err := s.Client.MakeRequest(MakeStoreRequestOptions{
-		Body:        data,
-		Key:         key,
-		Metadata:    options.Metadata,
-		Method:      HTTPMethodPut,
-		StoreName:   s.Name,
-		Consistency: &s.Client.Consistency,
-		Headers:     map[string]string{},
-		Parameters:  map[string]string{},
-	})
+	return &GetMetadataResult{
+		ETag:     res.Header.Get("etag"),
+		Metadata: metadata,
+		Size:     res.ContentLength,
+	}, nil
+}
 
-	if err != nil {
-		return err
+// GetRange retrieves length bytes of a value starting at offset. A length of
+// zero or less reads to the end of the value. It returns nil if the key does
+// not exist.
+func (s *Store) GetRange(key string, offset int64, length int64) (io.ReadCloser, error) {
+	return s.getRange(context.Background(), key, offset, length, "")
+}
+
+// getRange fetches a byte range of a key, failing with a
+// BlobsPreconditionError if etag is set and no longer matches.
+func (s *Store) getRange(ctx context.Context, key string, offset int64, length int64, etag string) (io.ReadCloser, error) {
+	headers := map[string]string{}
+	if length > 0 {
+		headers["range"] = fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)
+	} else {
+		headers["range"] = fmt.Sprintf("bytes=%d-", offset)
+	}
+	if etag != "" {
+		headers["if-match"] = etag
 	}
 
-	if res.StatusCode != 200 {
-		return NewBlobsInternalError(res)
+	res, err := s.get(ctx, key, HTTPMethodGet, headers)
+	if err != nil || res == nil {
+		return nil, err
 	}
 
-	return nil
-}
+	if etag != "" && res.Header.Get("etag") != "" && res.Header.Get("etag") != etag {
+		res.Body.Close()
+		return nil, NewBlobsPreconditionError(key)
+	}
 
-// SetOptions represents options when setting data in the store.
-type SetOptions struct {
-	Metadata Metadata `json:"metadata,omitempty"`
-}
+	if res.StatusCode == 206 {
+		return res.Body, nil
+	}
 
-// SetJSON stores JSON data in the store.
-func (s *Store) SetJSON(key string, data interface{}, options *SetOptions) error {
-	// Simulate storing JSON data
-	return nil
-}
+	// The range was ignored and the full value was returned, so skip to the
+	// requested window ourselves.
+	_, err = io.CopyN(io.Discard, res.Body, offset)
+	if err != nil && err != io.EOF {
+		res.Body.Close()
+		return nil, err
+	}
 
-// ListResultBlob represents a blob in the list result.
-type ListResultBlob struct {
-	ETag string `json:"etag"`
-	Key  string `json:"key"`
+	if length <= 0 {
+		return res.Body, nil
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(res.Body, length), res.Body}, nil
 }
 
-// ///////////////////////////////////////////////////////////////////////////
-type EnvironmentContext struct {
-	Edge_URL          string `json:"url,omitempty"`
-	Primary_Region    string `json:"primary_region,omitempty"`
-	Token             string `json:"token,omitempty"`
-	Uncached_Edge_URL string `json:"url_uncached,omitempty"`
+// DownloadState records the progress of a download so that it can be
+// resumed. It can be serialized and passed back through DownloadOptions.
+type DownloadState struct {
+	ETag      string `json:"etag"`
+	Size      int64  `json:"size"`
+	ChunkSize int64  `json:"chunk_size"`
+	Done      []bool `json:"done"`
+
+	mu sync.Mutex
 }
 
-type InvocationMetadata struct {
-	AccountTier      string `json:"accountTier,omitempty"`
-	BuildbotVersion  string `json:"buildbotVersion,omitempty"`
-	BuildVersion     string `json:"buildVersion,omitempty"`
-	Branch           string `json:"branch,omitempty"`
-	Framework        string `json:"framework,omitempty"`
-	FrameworkVersion string `json:"frameworkVersion,omitempty"`
-	FunctionName     string `json:"function_name,omitempty"`
-	Generator        string `json:"generator,omitempty"`
+// DownloadOptions represents options for DownloadTo.
+type DownloadOptions struct {
+	// ChunkSize is the size of each byte range. Defaults to 8 MiB.
+	ChunkSize int64
+	// Concurrency is the number of ranges fetched in parallel. Defaults to 4.
+	Concurrency int
+	// Retries is the number of times an interrupted range is resumed before
+	// giving up. Defaults to 3.
+	Retries int
+	// State, if set, is used to resume a previous download and is updated as
+	// ranges complete.
+	State *DownloadState
 }
 
-// APIGatewayRequestIdentity contains identity information for the request caller.
-type APIGatewayRequestIdentity struct {
-	CognitoIdentityPoolID         string `json:"cognitoIdentityPoolId,omitempty"`
-	AccountID                     string `json:"accountId,omitempty"`
-	CognitoIdentityID             string `json:"cognitoIdentityId,omitempty"`
-	Caller                        string `json:"caller,omitempty"`
-	APIKey                        string `json:"apiKey,omitempty"`
-	APIKeyID                      string `json:"apiKeyId,omitempty"`
-	AccessKey                     string `json:"accessKey,omitempty"`
-	SourceIP                      string `json:"sourceIp"`
-	CognitoAuthenticationType     string `json:"cognitoAuthenticationType,omitempty"`
-	CognitoAuthenticationProvider string `json:"cognitoAuthenticationProvider,omitempty"`
-	UserArn                       string `json:"userArn,omitempty"` //nolint: stylecheck
-	UserAgent                     string `json:"userAgent"`
-	User                          string `json:"user,omitempty"`
+// DownloadResult represents a completed download.
+type DownloadResult struct {
+	ETag string
+	Size int64
 }
 
-// APIGatewayProxyRequestContext contains the information to identify the AWS account and resources invoking the
-// Lambda function. It also includes Cognito identity information for the caller.
-type APIGatewayProxyRequestContext struct {
-	AccountID         string                    `json:"accountId"`
-	ResourceID        string                    `json:"resourceId"`
-	OperationName     string                    `json:"operationName,omitempty"`
-	Stage             string                    `json:"stage"`
-	DomainName        string                    `json:"domainName"`
-	DomainPrefix      string                    `json:"domainPrefix"`
-	RequestID         string                    `json:"requestId"`
-	ExtendedRequestID string                    `json:"extendedRequestId"`
-	Protocol          string                    `json:"protocol"`
-	Identity          APIGatewayRequestIdentity `json:"identity"`
-	ResourcePath      string                    `json:"resourcePath"`
-	Path              string                    `json:"path"`
-	Authorizer        map[string]interface{}    `json:"authorizer"`
-	HTTPMethod        string                    `json:"httpMethod"`
+// DownloadTo fetches a value into w using parallel byte ranges. Every range
+// is requested with the ETag seen when the download started, so a concurrent
+// overwrite fails with a BlobsPreconditionError instead of mixing two
+// versions. Interrupted ranges are resumed from the last byte written. It
+// returns nil if the key does not exist.
+func (s *Store) DownloadTo(ctx context.Context, key string, w io.WriterAt, options *DownloadOptions) (*DownloadResult, error) {
+	if options == nil {
+		options = &DownloadOptions{}
+	}
+
+	chunkSize := options.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = 8 << 20
+	}
+
+	concurrency := options.Concurrency
+	if concurrency <= 0 {
+		concurrency = 4
+	}
+
+	retries := options.Retries
+	if retries <= 0 {
+		retries = 3
+	}
+
+	res, err := s.get(ctx, key, HTTPMethodHead, map[string]string{})
+	if err != nil || res == nil {
+		return nil, err
+	}
+	res.Body.Close()
+
+	etag := res.Header.Get("etag")
+	size := res.ContentLength
+
+	// Without a size or ETag the value cannot be split safely, so it is
+	// streamed in one piece.
+	if size < 0 || etag == "" {
+		body, err := s.Get(key)
+		if err != nil || body == nil {
+			return nil, err
+		}
+		defer body.Close()
+
+		n, err := io.Copy(io.NewOffsetWriter(w, 0), body)
+		if err != nil {
+			return nil, err
+		}
+		return &DownloadResult{ETag: etag, Size: n}, nil
+	}
+
+	state := options.State
+	if state == nil {
+		state = &DownloadState{}
+	}
+
+	if state.ETag != "" && state.ETag != etag {
+		return nil, NewBlobsPreconditionError(key)
+	}
+
+	if state.ETag == "" || state.ChunkSize <= 0 {
+		state.ETag = etag
+		state.Size = size
+		state.ChunkSize = chunkSize
+		state.Done = make([]bool, (size+chunkSize-1)/chunkSize)
+	}
+
+	err = forEachConcurrent(ctx, len(state.Done), concurrency, func(ctx context.Context, i int) error {
+		state.mu.Lock()
+		done := state.Done[i]
+		state.mu.Unlock()
+		if done {
+			return nil
+		}
+
+		start := int64(i) * state.ChunkSize
+		length := state.ChunkSize
+		if start+length > size {
+			length = size - start
+		}
+
+		err := s.downloadRange(ctx, key, etag, w, start, length, retries)
+		if err != nil {
+			return err
+		}
+
+		state.mu.Lock()
+		state.Done[i] = true
+		state.mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &DownloadResult{ETag: etag, Size: size}, nil
+}
+
+func (s *Store) downloadRange(ctx context.Context, key string, etag string, w io.WriterAt, start int64, length int64, retries int) error {
+	var written int64
+
+	for attempt := 0; ; attempt++ {
+		body, err := s.getRange(ctx, key, start+written, length-written, etag)
+		if err == nil && body == nil {
+			return NewBlobsPreconditionError(key)
+		}
+
+		if err == nil {
+			var n int64
+			n, err = io.Copy(io.NewOffsetWriter(w, start+written), body)
+			body.Close()
+			written += n
+
+			if err == nil && written < length {
+				err = io.ErrUnexpectedEOF
+			}
+			if err == nil {
+				return nil
+			}
+		}
+
+		var preconditionError *BlobsPreconditionError
+		if errors.As(err, &preconditionError) || ctx.Err() != nil || attempt >= retries {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(attempt+1) * 200 * time.Millisecond):
+		}
+	}
+}
+
+// forEachConcurrent calls fn for every index in [0, n) using at most limit
+// goroutines. Scheduling stops once ctx is done or fn fails, and the first
+// error is returned.
+func forEachConcurrent(ctx context.Context, n int, limit int, fn func(ctx context.Context, i int) error) error {
+	if limit <= 0 {
+		limit = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	semaphore := make(chan struct{}, limit)
+
+	for i := 0; i < n; i++ {
+		select {
+		case <-ctx.Done():
+		case semaphore <- struct{}{}:
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+
+			err := fn(ctx, i)
+			if err != nil {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// CacheOptions represents the limits of a Cache.
+type CacheOptions struct {
+	// MaxBytes bounds the total size of cached values. Larger values are
+	// never cached.
+	MaxBytes int64
+	// MaxEntries bounds the number of cached values.
+	MaxEntries int
+	// TTL is how long a value is served without revalidation. Zero
+	// revalidates on every read.
+	TTL time.Duration
+	// TTLFor, if set, overrides TTL for individual keys. Returning a
+	// negative duration falls back to TTL.
+	TTLFor func(storeName string, key string) time.Duration
+}
+
+// CacheStats reports the activity of a Cache.
+type CacheStats struct {
+	Hits          int64 `json:"hits"`
+	Misses        int64 `json:"misses"`
+	Revalidations int64 `json:"revalidations"`
+	Evictions     int64 `json:"evictions"`
+	Entries       int   `json:"entries"`
+	Bytes         int64 `json:"bytes"`
+}
+
+// Cache is an in-memory LRU cache of blob values, bounded by bytes and
+// entry count. A Cache held in a package variable outlives a single
+// invocation, so warm Lambda invocations can reuse what earlier ones read.
+// Concurrent misses for the same key are coalesced into one request.
+type Cache struct {
+	options CacheOptions
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+	bytes   int64
+	stats   CacheStats
+	group   callGroup
+}
+
+type cacheEntry struct {
+	key       string
+	data      []byte
+	etag      string
+	metadata  Metadata
+	fetchedAt time.Time
+	ttl       time.Duration
+}
+
+// NewCache creates a cache with the given limits.
+func NewCache(options CacheOptions) *Cache {
+	return &Cache{
+		options: options,
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+	}
+}
+
+// Stats returns a snapshot of the cache statistics.
+func (c *Cache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Entries = c.order.Len()
+	stats.Bytes = c.bytes
+	return stats
+}
+
+// Remove drops a key from the cache.
+func (c *Cache) Remove(cacheKey string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[cacheKey]; ok {
+		c.removeElement(element)
+	}
+}
+
+// Purge drops every key from the cache.
+func (c *Cache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = map[string]*list.Element{}
+	c.order.Init()
+	c.bytes = 0
+}
+
+func (c *Cache) removeElement(element *list.Element) {
+	entry := element.Value.(*cacheEntry)
+	c.order.Remove(element)
+	delete(c.entries, entry.key)
+	c.bytes -= int64(len(entry.data))
+}
+
+func (c *Cache) lookup(cacheKey string) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[cacheKey]
+	if !ok {
+		return nil
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*cacheEntry)
+}
+
+func (c *Cache) add(entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[entry.key]; ok {
+		c.removeElement(element)
+	}
+
+	if c.options.MaxBytes > 0 && int64(len(entry.data)) > c.options.MaxBytes {
+		return
+	}
+
+	c.entries[entry.key] = c.order.PushFront(entry)
+	c.bytes += int64(len(entry.data))
+
+	for c.order.Len() > 0 &&
+		((c.options.MaxBytes > 0 && c.bytes > c.options.MaxBytes) ||
+			(c.options.MaxEntries > 0 && c.order.Len() > c.options.MaxEntries)) {
+		c.removeElement(c.order.Back())
+		c.stats.Evictions++
+	}
+}
+
+func (c *Cache) ttl(storeName string, key string) time.Duration {
+	if c.options.TTLFor != nil {
+		if ttl := c.options.TTLFor(storeName, key); ttl >= 0 {
+			return ttl
+		}
+	}
+	return c.options.TTL
+}
+
+func (c *Cache) count(counter *int64) {
+	c.mu.Lock()
+	*counter++
+	c.mu.Unlock()
+}
+
+func (e *cacheEntry) fresh() bool {
+	return time.Since(e.fetchedAt) < e.ttl
+}
+
+func (e *cacheEntry) result() *GetWithMetadataResult {
+	metadata := Metadata{}
+	for k, v := range e.metadata {
+		metadata[k] = v
+	}
+
+	return &GetWithMetadataResult{
+		Data:     io.NopCloser(bytes.NewReader(e.data)),
+		ETag:     e.etag,
+		Metadata: metadata,
+		Size:     int64(len(e.data)),
+	}
+}
+
+func (s *Store) cacheKey(key string) string {
+	return fmt.Sprintf("%s/%s/%s", s.Client.SiteID, s.Name, s.storedKey(key))
+}
+
+// errCacheBypass tells callers waiting on a coalesced read that the value
+// was too large to cache and must be fetched directly.
+var errCacheBypass = errors.New("value is too large to cache")
+
+// getCached serves a read from the cache. Concurrent misses share one
+// fetch, which runs with the context of the caller that started it.
+func (s *Store) getCached(ctx context.Context, key string) (*GetWithMetadataResult, error) {
+	cacheKey := s.cacheKey(key)
+
+	entry := s.Cache.lookup(cacheKey)
+	if entry != nil && entry.fresh() {
+		if isExpired(entry.metadata, time.Now()) {
+			s.Cache.Remove(cacheKey)
+			return nil, nil
+		}
+
+		s.Cache.count(&s.Cache.stats.Hits)
+		return entry.result(), nil
+	}
+
+	// Only the caller that runs the coalesced fetch sees an uncacheable
+	// value, so it keeps the body for itself.
+	var streamed *GetWithMetadataResult
+
+	value, err, _ := s.Cache.group.Do(cacheKey, func() (interface{}, error) {
+		stale := s.Cache.lookup(cacheKey)
+
+		headers := map[string]string{}
+		if stale != nil && stale.etag != "" {
+			headers["if-none-match"] = stale.etag
+		}
+
+		res, err := s.get(ctx, key, HTTPMethodGet, headers)
+		if err != nil {
+			return nil, err
+		}
+
+		if res == nil {
+			s.Cache.Remove(cacheKey)
+			return (*cacheEntry)(nil), nil
+		}
+
+		if res.StatusCode == 304 && stale != nil {
+			res.Body.Close()
+			s.Cache.count(&s.Cache.stats.Revalidations)
+
+			// A 304 carries no metadata, so the expiry of the unchanged
+			// value is checked against what was cached.
+			if isExpired(stale.metadata, time.Now()) {
+				s.Cache.Remove(cacheKey)
+				return (*cacheEntry)(nil), nil
+			}
+
+			refreshed := *stale
+			refreshed.fetchedAt = time.Now()
+			s.Cache.add(&refreshed)
+			return &refreshed, nil
+		}
+		s.Cache.count(&s.Cache.stats.Misses)
+
+		metadata, err := getMetadataFromResponse(res)
+		if err != nil {
+			res.Body.Close()
+			return nil, err
+		}
+
+		limit := s.Cache.options.MaxBytes
+		if limit <= 0 {
+			limit = math.MaxInt64 - 1
+		}
+
+		data, err := io.ReadAll(io.LimitReader(res.Body, limit+1))
+		if err != nil {
+			res.Body.Close()
+			return nil, err
+		}
+
+		if int64(len(data)) > limit {
+			streamed = &GetWithMetadataResult{
+				Data: struct {
+					io.Reader
+					io.Closer
+				}{io.MultiReader(bytes.NewReader(data), res.Body), res.Body},
+				ETag:     res.Header.Get("etag"),
+				Metadata: metadata,
+				Size:     res.ContentLength,
+			}
+			s.Cache.Remove(cacheKey)
+			return nil, errCacheBypass
+		}
+		res.Body.Close()
+
+		fetched := &cacheEntry{
+			key:       cacheKey,
+			data:      data,
+			etag:      res.Header.Get("etag"),
+			metadata:  metadata,
+			fetchedAt: time.Now(),
+			ttl:       s.Cache.ttl(s.Name, s.prefix+key),
+		}
+		s.Cache.add(fetched)
+		return fetched, nil
+	})
+
+	if streamed != nil {
+		return streamed, nil
+	}
+
+	if err == errCacheBypass {
+		uncached := *s
+		uncached.Cache = nil
+		return uncached.getWithMetadata(ctx, key)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	fetched := value.(*cacheEntry)
+	if fetched == nil {
+		return nil, nil
+	}
+	return fetched.result(), nil
+}
+
+// callGroup coalesces concurrent calls that share a key into one.
+type callGroup struct {
+	mu    sync.Mutex
+	calls map[string]*groupCall
+}
+
+type groupCall struct {
+	wg    sync.WaitGroup
+	value interface{}
+	err   error
+}
+
+// Do runs fn once for all concurrent callers with the same key and hands
+// every caller its result. The boolean result reports whether the result
+// was shared with other callers.
+func (g *callGroup) Do(key string, fn func() (interface{}, error)) (interface{}, error, bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = map[string]*groupCall{}
+	}
+	if call, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		call.wg.Wait()
+		return call.value, call.err, true
+	}
+
+	call := &groupCall{}
+	call.wg.Add(1)
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	call.value, call.err = fn()
+	call.wg.Done()
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+
+	return call.value, call.err, false
+}
+
+// ListOptions represents options for listing store items.
+type ListOptions struct {
+	Directories bool   `json:"directories,omitempty"`
+	Paginate    bool   `json:"paginate,omitempty"`
+	Prefix      string `json:"prefix,omitempty"`
+}
+
+// ListResult represents the result of a list operation.
+type ListResult struct {
+	Blobs       []ListResultBlob `json:"blobs"`
+	Directories []string         `json:"directories"`
+}
+
+// ListResponse represents a single page returned by the list endpoint.
+type ListResponse struct {
+	Blobs       []ListResponseBlob `json:"blobs"`
+	Directories []string           `json:"directories"`
+	NextCursor  string             `json:"next_cursor,omitempty"`
+}
+
+func (s *Store) listPage(options *ListOptions, cursor string) (*ListResponse, error) {
+	parameters := map[string]string{}
+	if prefix := s.storedKey(options.Prefix); prefix != "" {
+		parameters["prefix"] = prefix
+	}
+	if options.Directories {
+		parameters["directories"] = "true"
+	}
+	if cursor != "" {
+		parameters["cursor"] = cursor
+	}
+
+	res, err := s.Client.MakeRequest(MakeStoreRequestOptions{
+		Consistency: &s.Client.Consistency,
+		Headers:     map[string]string{},
+		Method:      HTTPMethodGet,
+		Parameters:  parameters,
+		StoreName:   s.Name,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == 404 {
+		return &ListResponse{}, nil
+	}
+
+	if res.StatusCode != 200 {
+		return nil, NewBlobsInternalError(res)
+	}
+
+	var page ListResponse
+	err = json.NewDecoder(res.Body).Decode(&page)
+	if err != nil {
+		return nil, err
+	}
+
+	return &page, nil
+}
+
+// ListPages walks the listing one page at a time, calling fn for each page.
+// Walking stops at the first error returned by fn.
+func (s *Store) ListPages(options *ListOptions, fn func(page *ListResult) error) error {
+	if options == nil {
+		options = &ListOptions{}
+	}
+
+	cursor := ""
+	for {
+		page, err := s.listPage(options, cursor)
+		if err != nil {
+			return err
+		}
+
+		result := &ListResult{
+			Blobs:       make([]ListResultBlob, 0, len(page.Blobs)),
+			Directories: make([]string, 0, len(page.Directories)),
+		}
+		for _, directory := range page.Directories {
+			directory, err := s.listedKey(directory)
+			if err != nil {
+				return err
+			}
+			result.Directories = append(result.Directories, directory)
+		}
+		for _, blob := range page.Blobs {
+			key, err := s.listedKey(blob.Key)
+			if err != nil {
+				return err
+			}
+			result.Blobs = append(result.Blobs, ListResultBlob{
+				ETag:         blob.ETag,
+				Key:          key,
+				LastModified: blob.LastModified,
+				Size:         blob.Size,
+			})
+		}
+
+		err = fn(result)
+		if err != nil {
+			return err
+		}
+
+		if page.NextCursor == "" {
+			return nil
+		}
+		cursor = page.NextCursor
+	}
+}
+
+// List lists store items based on the options, following pagination
+// until every page has been read.
+func (s *Store) List(options *ListOptions) (*ListResult, error) {
+	result := &ListResult{
+		Blobs:       []ListResultBlob{},
+		Directories: []string{},
+	}
+
+	err := s.ListPages(options, func(page *ListResult) error {
+		result.Blobs = append(result.Blobs, page.Blobs...)
+		result.Directories = append(result.Directories, page.Directories...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func validateKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("key must not be empty")
+	}
+
+	if strings.HasPrefix(key, "/") {
+		return fmt.Errorf("key must not start with forward slash (/)")
+	}
+
+	if len(key) > 600 {
+		return fmt.Errorf(
+			"key must be a sequence of Unicode characters whose UTF-8 encoding is at most 600 bytes long",
+		)
+	}
+	return nil
+}
+
+// contentLength returns the number of bytes left to read from data, or -1
+// if the length cannot be known without consuming it.
+func contentLength(data BlobInput) int64 {
+	switch v := data.(type) {
+	case nil:
+		return 0
+	case interface{ Len() int }:
+		return int64(v.Len())
+	case *os.File:
+		info, err := v.Stat()
+		if err != nil || !info.Mode().IsRegular() {
+			return -1
+		}
+		offset, err := v.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return -1
+		}
+		return info.Size() - offset
+	case io.Seeker:
+		offset, err := v.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return -1
+		}
+		end, err := v.Seek(0, io.SeekEnd)
+		if err != nil {
+			return -1
+		}
+		_, err = v.Seek(offset, io.SeekStart)
+		if err != nil {
+			return -1
+		}
+		return end - offset
+	}
+	return -1
+}
+
+// progressReader reports the number of bytes read so far to a callback.
+type progressReader struct {
+	reader   io.Reader
+	progress func(written int64, total int64)
+	total    int64
+	written  int64
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		r.written += int64(n)
+		r.progress(r.written, r.total)
+	}
+	return n, err
+}
+
+// Set stores data in the store. Signed uploads need a Content-Length, so the
+// size is taken from SetOptions.Size, detected from the reader, or, for
+// readers of unknown length, found by buffering the data in memory.
+func (s *Store) Set(key string, data BlobInput, options *SetOptions) error {
+	_, err := s.set(context.Background(), key, data, options)
+	return err
+}
+
+// set stores data in the store and returns the ETag reported for the write,
+// which may be empty.
+func (s *Store) set(ctx context.Context, key string, data BlobInput, options *SetOptions) (string, error) {
+	err := s.checkKey(key)
+	if err != nil {
+		return "", err
+	}
+
+	if options == nil {
+		options = &SetOptions{}
+	}
+
+	if s.Cache != nil {
+		defer s.Cache.Remove(s.cacheKey(key))
+	}
+
+	size := options.Size
+	if size <= 0 {
+		size = contentLength(data)
+	}
+
+	if size < 0 {
+		buffered, err := io.ReadAll(data)
+		if err != nil {
+			return "", err
+		}
+		data = bytes.NewReader(buffered)
+		size = int64(len(buffered))
+	}
+
+	metadata := options.storedMetadata()
+	if len(metadata) == 0 {
+		metadata = nil
+	}
+
+	headers := map[string]string{}
+	if options.OnlyIfMatch != "" {
+		headers["if-match"] = options.OnlyIfMatch
+	}
+	if options.OnlyIfNew {
+		headers["if-none-match"] = "*"
+	}
+
+	if size == 0 {
+		data = http.NoBody
+	} else if options.Progress != nil {
+		data = &progressReader{
+			reader:   data,
+			progress: options.Progress,
+			total:    size,
+		}
+	}
+
+	res, err := s.Client.MakeRequest(MakeStoreRequestOptions{
+		Body:          data,
+		Context:       ctx,
+		ContentLength: size,
+		Key:           s.storedKey(key),
+		Metadata:      metadata,
+		Method:        HTTPMethodPut,
+		StoreName:     s.Name,
+		Consistency:   &s.Client.Consistency,
+		Headers:       headers,
+		Parameters:    map[string]string{},
+	})
+
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == 412 {
+		return "", NewBlobsPreconditionError(key)
+	}
+
+	if res.StatusCode != 200 {
+		return "", NewBlobsInternalError(res)
+	}
+
+	return res.Header.Get("etag"), nil
+}
+
+// SetOptions represents options when setting data in the store.
+type SetOptions struct {
+	Metadata Metadata `json:"metadata,omitempty"`
+	// Size is the number of bytes that will be read from the data. Zero
+	// means the size is detected from the reader.
+	Size int64 `json:"size,omitempty"`
+	// Progress, if set, is called as the upload body is read with the
+	// number of bytes sent so far and the total size.
+	Progress func(written int64, total int64) `json:"-"`
+	// ExpiresAt, if set, is when the blob stops being readable.
+	ExpiresAt time.Time `json:"expiresAt,omitempty"`
+	// TTL, if set and ExpiresAt is not, expires the blob this long after it
+	// is written.
+	TTL time.Duration `json:"ttl,omitempty"`
+	// OnlyIfMatch, if set, only writes the blob if its current ETag matches.
+	// Otherwise Set fails with a BlobsPreconditionError.
+	OnlyIfMatch string `json:"onlyIfMatch,omitempty"`
+	// OnlyIfNew only writes the blob if the key does not exist yet.
+	// Otherwise Set fails with a BlobsPreconditionError.
+	OnlyIfNew bool `json:"onlyIfNew,omitempty"`
+}
+
+// EXPIRES_AT_METADATA_KEY records the expiry of a blob in Unix milliseconds.
+const EXPIRES_AT_METADATA_KEY = "_expires_at"
+
+// storedMetadata returns a copy of the user metadata with the expiry added.
+func (o *SetOptions) storedMetadata() Metadata {
+	expiresAt := o.ExpiresAt
+	if expiresAt.IsZero() && o.TTL > 0 {
+		expiresAt = time.Now().Add(o.TTL)
+	}
+
+	metadata := Metadata{}
+	for k, v := range o.Metadata {
+		metadata[k] = v
+	}
+
+	if !expiresAt.IsZero() {
+		metadata[EXPIRES_AT_METADATA_KEY] = expiresAt.UnixMilli()
+	}
+
+	return metadata
+}
+
+// isExpired reports whether metadata carries an expiry that has passed.
+func isExpired(metadata Metadata, now time.Time) bool {
+	expiresAt, ok := metadata[EXPIRES_AT_METADATA_KEY].(float64)
+	if !ok {
+		return false
+	}
+	return now.UnixMilli() >= int64(expiresAt)
+}
+
+// SetJSON stores JSON data in the store.
+func (s *Store) SetJSON(key string, data interface{}, options *SetOptions) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	return s.Set(key, bytes.NewReader(payload), options)
+}
+
+// ListResultBlob represents a blob in the list result.
+type ListResultBlob struct {
+	ETag         string `json:"etag"`
+	Key          string `json:"key"`
+	LastModified string `json:"last_modified,omitempty"`
+	Size         int64  `json:"size,omitempty"`
+}
+
+// MigrateOptions represents options for copying blobs between stores.
+type MigrateOptions struct {
+	// Prefix limits the migration to keys that start with it.
+	Prefix string
+	// Checkpoint is the last key copied by a previous run. Keys sorting at or
+	// before it are skipped, so an interrupted migration can be resumed.
+	Checkpoint string
+	// TransformKey maps a source key to its destination key. Returning an
+	// empty key skips the blob.
+	TransformKey func(key string) (string, error)
+	// Progress is called after each blob has been handled.
+	Progress func(progress MigrateProgress)
+}
+
+// MigrateProgress reports the state of a running migration.
+type MigrateProgress struct {
+	Key            string
+	DestinationKey string
+	Copied         int
+	Skipped        int
+	Total          int
+}
+
+// MigrateResult represents the outcome of a migration. Checkpoint holds the
+// last key handled, which can be passed back in MigrateOptions to resume.
+type MigrateResult struct {
+	Checkpoint string
+	Copied     int
+	Skipped    int
+}
+
+// Migrate copies every blob under an optional prefix from the source store
+// to the destination store, preserving metadata. The stores may use
+// different clients, so blobs can be moved across sites and regions.
+func Migrate(source *Store, destination *Store, options *MigrateOptions) (*MigrateResult, error) {
+	if options == nil {
+		options = &MigrateOptions{}
+	}
+
+	listing, err := source.List(&ListOptions{Prefix: options.Prefix})
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(listing.Blobs))
+	for _, blob := range listing.Blobs {
+		if options.Checkpoint != "" && blob.Key <= options.Checkpoint {
+			continue
+		}
+		keys = append(keys, blob.Key)
+	}
+	sort.Strings(keys)
+
+	result := &MigrateResult{Checkpoint: options.Checkpoint}
+
+	for _, key := range keys {
+		destinationKey := key
+		if options.TransformKey != nil {
+			destinationKey, err = options.TransformKey(key)
+			if err != nil {
+				return result, fmt.Errorf("transforming key %q: %w", key, err)
+			}
+		}
+
+		copied := false
+		if destinationKey != "" {
+			copied, err = migrateBlob(source, destination, key, destinationKey)
+			if err != nil {
+				return result, fmt.Errorf("copying key %q: %w", key, err)
+			}
+		}
+
+		if copied {
+			result.Copied++
+		} else {
+			result.Skipped++
+		}
+		result.Checkpoint = key
+
+		if options.Progress != nil {
+			options.Progress(MigrateProgress{
+				Key:            key,
+				DestinationKey: destinationKey,
+				Copied:         result.Copied,
+				Skipped:        result.Skipped,
+				Total:          len(keys),
+			})
+		}
+	}
+
+	return result, nil
+}
+
+func migrateBlob(source *Store, destination *Store, key string, destinationKey string) (bool, error) {
+	entry, err := source.GetWithMetadata(key)
+	if err != nil {
+		return false, err
+	}
+
+	// The blob was deleted after the listing was taken.
+	if entry == nil {
+		return false, nil
+	}
+	defer entry.Data.Close()
+
+	err = destination.Set(destinationKey, entry.Data, &SetOptions{
+		Metadata: entry.Metadata,
+		Size:     entry.Size,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// CHUNKS_PREFIX is the key prefix under which chunked uploads store parts.
+const CHUNKS_PREFIX = ".chunks/"
+
+// CHUNKED_METADATA_KEY marks a manifest blob with the ID of its upload.
+const CHUNKED_METADATA_KEY = "_chunked_upload"
+
+// ChunkManifest describes the parts that make up a chunked value.
+type ChunkManifest struct {
+	UploadID  string      `json:"upload_id"`
+	Size      int64       `json:"size"`
+	ChunkSize int64       `json:"chunk_size"`
+	Chunks    []ChunkInfo `json:"chunks"`
+}
+
+// ChunkInfo describes a single part of a chunked value.
+type ChunkInfo struct {
+	Key    string `json:"key"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// ChunkedStore stores values larger than a single object by splitting them
+// into parts. The parts are written first and the manifest last, so a value
+// only becomes visible once every part has been uploaded.
+type ChunkedStore struct {
+	Store *Store
+	// ChunkSize is the size of each part. Defaults to 64 MiB.
+	ChunkSize int64
+}
+
+// NewChunkedStore creates a chunked store on top of an existing store.
+func NewChunkedStore(store *Store, chunkSize int64) *ChunkedStore {
+	if chunkSize <= 0 {
+		chunkSize = DEFAULT_CHUNK_SIZE
+	}
+	return &ChunkedStore{
+		Store:     store,
+		ChunkSize: chunkSize,
+	}
+}
+
+// DEFAULT_CHUNK_SIZE is the part size used when ChunkSize is not set.
+const DEFAULT_CHUNK_SIZE = 64 << 20
+
+func (c *ChunkedStore) chunkSize() int64 {
+	if c.ChunkSize <= 0 {
+		return DEFAULT_CHUNK_SIZE
+	}
+	return c.ChunkSize
+}
+
+// newUploadID returns an ID that sorts by creation time.
+func newUploadID() (string, error) {
+	suffix := make([]byte, 4)
+	_, err := rand.Read(suffix)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%016x%s", time.Now().UnixNano(), hex.EncodeToString(suffix)), nil
+}
+
+// uploadTime returns the time encoded in an upload ID.
+func uploadTime(uploadID string) (time.Time, error) {
+	if len(uploadID) < 16 {
+		return time.Time{}, fmt.Errorf("invalid upload ID %q", uploadID)
+	}
+	nanos, err := strconv.ParseInt(uploadID[:16], 16, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, nanos), nil
+}
+
+func chunkPrefix(key string, uploadID string) string {
+	return fmt.Sprintf("%s%s/%s/", CHUNKS_PREFIX, key, uploadID)
+}
+
+// Set splits data into parts, uploads them and then commits the manifest.
+func (c *ChunkedStore) Set(key string, data io.Reader, options *SetOptions) error {
+	err := c.Store.checkKey(key)
+	if err != nil {
+		return err
+	}
+
+	if options == nil {
+		options = &SetOptions{}
+	}
+
+	uploadID, err := newUploadID()
+	if err != nil {
+		return err
+	}
+
+	manifest := ChunkManifest{
+		UploadID:  uploadID,
+		ChunkSize: c.chunkSize(),
+		Chunks:    []ChunkInfo{},
+	}
+	buffer := make([]byte, manifest.ChunkSize)
+
+	for index := 0; ; index++ {
+		n, err := io.ReadFull(data, buffer)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		chunk := buffer[:n]
+		sum := sha256.Sum256(chunk)
+		chunkKey := fmt.Sprintf("%s%08d", chunkPrefix(key, uploadID), index)
+
+		err = c.Store.Set(chunkKey, bytes.NewReader(chunk), nil)
+		if err != nil {
+			return fmt.Errorf("uploading part %d: %w", index, err)
+		}
+
+		manifest.Chunks = append(manifest.Chunks, ChunkInfo{
+			Key:    chunkKey,
+			Size:   int64(n),
+			SHA256: hex.EncodeToString(sum[:]),
+		})
+		manifest.Size += int64(n)
+
+		if n < len(buffer) {
+			break
+		}
+	}
+
+	payload, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	metadata := options.storedMetadata()
+	metadata[CHUNKED_METADATA_KEY] = uploadID
+
+	return c.Store.Set(key, bytes.NewReader(payload), &SetOptions{
+		Metadata: metadata,
+	})
+}
+
+// GetManifest retrieves the manifest of a chunked value. It returns nil if
+// the key does not exist or was not written in chunks.
+func (c *ChunkedStore) GetManifest(key string) (*ChunkManifest, error) {
+	entry, err := c.Store.GetWithMetadata(key)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	defer entry.Data.Close()
+
+	if _, ok := entry.Metadata[CHUNKED_METADATA_KEY]; !ok {
+		return nil, nil
+	}
+
+	var manifest ChunkManifest
+	err = json.NewDecoder(entry.Data).Decode(&manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	return &manifest, nil
+}
+
+// Get retrieves a value, streaming its parts in order and verifying each
+// part's hash as it is read. Values that were not written in chunks are
+// returned as they are. It returns nil if the key does not exist.
+func (c *ChunkedStore) Get(key string) (io.ReadCloser, error) {
+	entry, err := c.Store.GetWithMetadata(key)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+
+	if _, ok := entry.Metadata[CHUNKED_METADATA_KEY]; !ok {
+		return entry.Data, nil
+	}
+	defer entry.Data.Close()
+
+	var manifest ChunkManifest
+	err = json.NewDecoder(entry.Data).Decode(&manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	return &chunkReader{
+		store:    c.Store,
+		manifest: &manifest,
+	}, nil
+}
+
+// chunkReader reassembles a chunked value one part at a time.
+type chunkReader struct {
+	store    *Store
+	manifest *ChunkManifest
+	index    int
+	current  io.ReadCloser
+	hash     hash.Hash
+	read     int64
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if r.index >= len(r.manifest.Chunks) {
+				return 0, io.EOF
+			}
+
+			chunk := r.manifest.Chunks[r.index]
+			body, err := r.store.Get(chunk.Key)
+			if err != nil {
+				return 0, err
+			}
+			if body == nil {
+				return 0, fmt.Errorf("part %q of upload %s is missing", chunk.Key, r.manifest.UploadID)
+			}
+
+			r.current = body
+			r.hash = sha256.New()
+			r.read = 0
+		}
+
+		n, err := r.current.Read(p)
+		r.hash.Write(p[:n])
+		r.read += int64(n)
+
+		if err == io.EOF {
+			chunk := r.manifest.Chunks[r.index]
+			r.current.Close()
+			r.current = nil
+			r.index++
+
+			if r.read != chunk.Size || hex.EncodeToString(r.hash.Sum(nil)) != chunk.SHA256 {
+				return n, fmt.Errorf("part %q of upload %s is corrupted", chunk.Key, r.manifest.UploadID)
+			}
+
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+
+		return n, err
+	}
+}
+
+func (r *chunkReader) Close() error {
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
+}
+
+// Delete removes the manifest of a chunked value and then its parts.
+func (c *ChunkedStore) Delete(key string) error {
+	manifest, err := c.GetManifest(key)
+	if err != nil {
+		return err
+	}
+
+	err = c.Store.Delete(key)
+	if err != nil {
+		return err
+	}
+
+	if manifest == nil {
+		return nil
+	}
+
+	return forEachConcurrent(context.Background(), len(manifest.Chunks), 8, func(ctx context.Context, i int) error {
+		return c.Store.Delete(manifest.Chunks[i].Key)
+	})
+}
+
+// ChunkGCResult represents the outcome of a chunk garbage collection.
+type ChunkGCResult struct {
+	DeletedParts   int
+	DeletedUploads int
+}
+
+// GarbageCollect removes the parts of uploads that were never committed or
+// have since been replaced. Uploads younger than gracePeriod are kept so
+// that uploads still in progress are not disturbed.
+func (c *ChunkedStore) GarbageCollect(ctx context.Context, gracePeriod time.Duration) (*ChunkGCResult, error) {
+	listing, err := c.Store.List(&ListOptions{Prefix: CHUNKS_PREFIX})
+	if err != nil {
+		return nil, err
+	}
+
+	// Group parts by the key and upload they belong to. Part keys have the
+	// form .chunks/<key>/<upload ID>/<index>, and key may contain slashes.
+	uploads := map[string]map[string][]string{}
+	for _, blob := range listing.Blobs {
+		segments := strings.Split(strings.TrimPrefix(blob.Key, CHUNKS_PREFIX), "/")
+		if len(segments) < 3 {
+			continue
+		}
+		key := strings.Join(segments[:len(segments)-2], "/")
+		uploadID := segments[len(segments)-2]
+
+		if uploads[key] == nil {
+			uploads[key] = map[string][]string{}
+		}
+		uploads[key][uploadID] = append(uploads[key][uploadID], blob.Key)
+	}
+
+	result := &ChunkGCResult{}
+	garbage := []string{}
+
+	for key, byUpload := range uploads {
+		current := ""
+		metadata, err := c.Store.GetMetadata(key)
+		if err != nil {
+			return nil, err
+		}
+		if metadata != nil {
+			current, _ = metadata.Metadata[CHUNKED_METADATA_KEY].(string)
+		}
+
+		for uploadID, parts := range byUpload {
+			if uploadID == current {
+				continue
+			}
+
+			created, err := uploadTime(uploadID)
+			if err == nil && time.Since(created) < gracePeriod {
+				continue
+			}
+
+			garbage = append(garbage, parts...)
+			result.DeletedUploads++
+		}
+	}
+
+	err = forEachConcurrent(ctx, len(garbage), 8, func(ctx context.Context, i int) error {
+		return c.Store.Delete(garbage[i])
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.DeletedParts = len(garbage)
+
+	return result, nil
+}
+
+// CONTENT_PREFIX is the key prefix under which content-addressed blobs are
+// stored by their SHA-256 digest.
+const CONTENT_PREFIX = ".cas/sha256/"
+
+// CONTENT_METADATA_KEY marks a pointer record with the digest it refers to.
+const CONTENT_METADATA_KEY = "_content_sha256"
+
+// CONTENT_WRITTEN_AT_METADATA_KEY records when content was last uploaded,
+// in Unix milliseconds.
+const CONTENT_WRITTEN_AT_METADATA_KEY = "_content_written_at"
+
+// CONTENT_REFRESH_AFTER is the refresh interval used when RefreshAfter is
+// not set.
+const CONTENT_REFRESH_AFTER = time.Hour
+
+// ContentPointer is the record stored under a user key in a
+// content-addressed store.
+type ContentPointer struct {
+	SHA256 string `json:"sha256"`
+	Size   int64  `json:"size"`
+}
+
+// ContentAddressedStore deduplicates values by storing each distinct
+// payload once under its SHA-256 digest. User keys hold small pointer
+// records that carry the user metadata.
+//
+// Content that already exists is not uploaded again unless it is older
+// than RefreshAfter. Refreshing it keeps reused content inside the
+// collection grace period, which GarbageCollect never lets drop below twice
+// RefreshAfter, so a collection cannot sweep content that a Set in
+// progress has just decided to reuse, as long as the Set and the marking
+// phase of the collection each take well under RefreshAfter.
+type ContentAddressedStore struct {
+	Store *Store
+	// RefreshAfter is the age after which reused content is uploaded again.
+	// Defaults to CONTENT_REFRESH_AFTER. Shorter intervals let collections
+	// run with shorter grace periods at the cost of more uploads.
+	RefreshAfter time.Duration
+}
+
+func (c *ContentAddressedStore) refreshAfter() time.Duration {
+	if c.RefreshAfter <= 0 {
+		return CONTENT_REFRESH_AFTER
+	}
+	return c.RefreshAfter
+}
+
+// NewContentAddressedStore creates a content-addressed store on top of an
+// existing store.
+func NewContentAddressedStore(store *Store) *ContentAddressedStore {
+	return &ContentAddressedStore{
+		Store: store,
+	}
+}
+
+// Set stores data under its digest, unless identical content was uploaded
+// within RefreshAfter, and points key at it. The data is spooled to a
+// temporary file while it is hashed.
+func (c *ContentAddressedStore) Set(key string, data io.Reader, options *SetOptions) error {
+	err := c.Store.checkKey(key)
+	if err != nil {
+		return err
+	}
+
+	if options == nil {
+		options = &SetOptions{}
+	}
+
+	spool, err := os.CreateTemp("", "cas-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	digest := sha256.New()
+	size, err := io.Copy(io.MultiWriter(spool, digest), data)
+	if err != nil {
+		return err
+	}
+	sum := hex.EncodeToString(digest.Sum(nil))
+	contentKey := CONTENT_PREFIX + sum
+
+	existing, err := c.Store.GetMetadata(contentKey)
+	if err != nil {
+		return err
+	}
+	if existing == nil || !c.isFresh(existing.Metadata) {
+		err = c.writeContent(contentKey, spool)
+		if err != nil {
+			return err
+		}
+	}
+
+	payload, err := json.Marshal(ContentPointer{SHA256: sum, Size: size})
+	if err != nil {
+		return err
+	}
+
+	metadata := options.storedMetadata()
+	metadata[CONTENT_METADATA_KEY] = sum
+
+	err = c.Store.Set(key, bytes.NewReader(payload), &SetOptions{
+		Metadata: metadata,
+	})
+	if err != nil {
+		return err
+	}
+
+	// A collection running between the existence check and the pointer
+	// write could have swept the content, so check once more now that the
+	// pointer protects it.
+	return c.ensureContent(contentKey, spool)
+}
+
+// isFresh reports whether content with the given metadata was uploaded
+// within RefreshAfter.
+func (c *ContentAddressedStore) isFresh(metadata Metadata) bool {
+	writtenAt, ok := metadata[CONTENT_WRITTEN_AT_METADATA_KEY].(float64)
+	return ok && time.Since(time.UnixMilli(int64(writtenAt))) < c.refreshAfter()
+}
+
+// writeContent uploads content even if it already exists. Rewriting it
+// moves its modification time out of the collection grace period and
+// changes its ETag, which makes a collection that listed it earlier skip
+// it.
+func (c *ContentAddressedStore) writeContent(contentKey string, spool *os.File) error {
+	_, err := spool.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	return c.Store.Set(contentKey, spool, &SetOptions{
+		Metadata: Metadata{CONTENT_WRITTEN_AT_METADATA_KEY: time.Now().UnixMilli()},
+	})
+}
+
+func (c *ContentAddressedStore) ensureContent(contentKey string, spool *os.File) error {
+	existing, err := c.Store.GetMetadata(contentKey)
+	if err != nil || existing != nil {
+		return err
+	}
+
+	return c.writeContent(contentKey, spool)
+}
+
+// Get resolves the pointer stored under key and returns the content it
+// refers to. Values that are not pointers are returned as they are. It
+// returns nil if the key does not exist.
+func (c *ContentAddressedStore) Get(key string) (io.ReadCloser, error) {
+	entry, err := c.Store.GetWithMetadata(key)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+
+	if _, ok := entry.Metadata[CONTENT_METADATA_KEY]; !ok {
+		return entry.Data, nil
+	}
+	defer entry.Data.Close()
+
+	var pointer ContentPointer
+	err = json.NewDecoder(entry.Data).Decode(&pointer)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := c.Store.Get(CONTENT_PREFIX + pointer.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	if content == nil {
+		return nil, fmt.Errorf("content %s referenced by key %q is missing", pointer.SHA256, key)
+	}
+
+	return content, nil
+}
+
+// Delete removes the pointer stored under key. The content it referred to
+// is removed by GarbageCollect once nothing else points at it.
+func (c *ContentAddressedStore) Delete(key string) error {
+	return c.Store.Delete(key)
+}
+
+// ContentGCResult represents the outcome of a content garbage collection.
+type ContentGCResult struct {
+	Referenced int
+	Deleted    int
+}
+
+// GarbageCollect marks every digest referenced by a pointer and sweeps
+// content that is unreferenced. Content modified within gracePeriod, which
+// is raised to at least twice RefreshAfter, is kept so that writes in
+// progress are not disturbed, and content is only deleted while its ETag
+// matches the listing, so content rewritten by a concurrent Set survives.
+func (c *ContentAddressedStore) GarbageCollect(ctx context.Context, gracePeriod time.Duration) (*ContentGCResult, error) {
+	if gracePeriod < 2*c.refreshAfter() {
+		gracePeriod = 2 * c.refreshAfter()
+	}
+
+	listing, err := c.Store.List(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	pointers := []string{}
+	contents := []ListResultBlob{}
+	for _, blob := range listing.Blobs {
+		if strings.HasPrefix(blob.Key, CONTENT_PREFIX) {
+			contents = append(contents, blob)
+		} else {
+			pointers = append(pointers, blob.Key)
+		}
+	}
+
+	var mu sync.Mutex
+	marked := map[string]bool{}
+
+	err = forEachConcurrent(ctx, len(pointers), 8, func(ctx context.Context, i int) error {
+		metadata, err := c.Store.GetMetadata(pointers[i])
+		if err != nil || metadata == nil {
+			return err
+		}
+
+		if sum, ok := metadata.Metadata[CONTENT_METADATA_KEY].(string); ok {
+			mu.Lock()
+			marked[sum] = true
+			mu.Unlock()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	garbage := []ListResultBlob{}
+	for _, blob := range contents {
+		if marked[strings.TrimPrefix(blob.Key, CONTENT_PREFIX)] {
+			continue
+		}
+
+		modified, err := time.Parse(time.RFC3339, blob.LastModified)
+		if err != nil || time.Since(modified) < gracePeriod {
+			continue
+		}
+
+		garbage = append(garbage, blob)
+	}
+
+	var deleted int64
+	err = forEachConcurrent(ctx, len(garbage), 8, func(ctx context.Context, i int) error {
+		err := c.Store.delete(ctx, garbage[i].Key, garbage[i].ETag)
+
+		var preconditionError *BlobsPreconditionError
+		if errors.As(err, &preconditionError) {
+			return nil
+		}
+		if err == nil {
+			atomic.AddInt64(&deleted, 1)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &ContentGCResult{
+		Referenced: len(marked),
+		Deleted:    int(deleted),
+	}, nil
+}
+
+// ENCRYPTION_METADATA_KEY holds the envelope of an encrypted blob.
+const ENCRYPTION_METADATA_KEY = "_encryption"
+
+// ENCRYPTION_ALGORITHM identifies the segmented AES-GCM format used for
+// encrypted blobs, in which every segment is bound to the blob's store, key
+// and envelope.
+const ENCRYPTION_ALGORITHM = "AES-256-GCM-STREAM-V2"
+
+// KeyProvider wraps and unwraps the per-blob data keys of an EncryptedStore.
+type KeyProvider interface {
+	// WrapKey encrypts a data key and returns the ID of the key used.
+	WrapKey(dataKey []byte) (keyID string, wrapped []byte, err error)
+	// UnwrapKey decrypts a data key wrapped with the given key ID.
+	UnwrapKey(keyID string, wrapped []byte) ([]byte, error)
+}
+
+// Keyring is a KeyProvider holding several AES-256 key-encryption keys.
+// New blobs are wrapped with the current key, while blobs wrapped with
+// older keys can still be read, so keys can be rotated without rewriting
+// existing data.
+type Keyring struct {
+	Current string
+	Keys    map[string][]byte
+
+	mu sync.RWMutex
+}
+
+// NewKeyring creates a keyring that wraps new data keys with current.
+func NewKeyring(current string, keys map[string][]byte) (*Keyring, error) {
+	if _, ok := keys[current]; !ok {
+		return nil, fmt.Errorf("keyring has no key with ID %q", current)
+	}
+	return &Keyring{
+		Current: current,
+		Keys:    keys,
+	}, nil
+}
+
+// NewStaticKeyProvider creates a key provider with a single key.
+func NewStaticKeyProvider(keyID string, key []byte) (*Keyring, error) {
+	return NewKeyring(keyID, map[string][]byte{keyID: key})
+}
+
+// Rotate adds a key and makes it the one used for new blobs.
+func (k *Keyring) Rotate(keyID string, key []byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.Keys == nil {
+		k.Keys = map[string][]byte{}
+	}
+	k.Keys[keyID] = key
+	k.Current = keyID
+}
+
+func (k *Keyring) WrapKey(dataKey []byte) (string, []byte, error) {
+	k.mu.RLock()
+	keyID := k.Current
+	key, ok := k.Keys[keyID]
+	k.mu.RUnlock()
+
+	if !ok {
+		return "", nil, fmt.Errorf("keyring has no key with ID %q", keyID)
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return "", nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return keyID, aead.Seal(nonce, nonce, dataKey, []byte(keyID)), nil
+}
+
+func (k *Keyring) UnwrapKey(keyID string, wrapped []byte) ([]byte, error) {
+	k.mu.RLock()
+	key, ok := k.Keys[keyID]
+	k.mu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("keyring has no key with ID %q", keyID)
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(wrapped) < aead.NonceSize() {
+		return nil, fmt.Errorf("wrapped data key is too short")
+	}
+
+	nonce, ciphertext := wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, []byte(keyID))
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptionEnvelope is stored in the metadata of an encrypted blob.
+type EncryptionEnvelope struct {
+	Algorithm   string `json:"alg"`
+	KeyID       string `json:"key_id"`
+	WrappedKey  string `json:"wrapped_key"`
+	Nonce       string `json:"nonce"`
+	SegmentSize int    `json:"segment_size"`
+}
+
+// EncryptedStore encrypts values on the client before they are stored.
+// Every blob gets its own AES-256 data key, which is wrapped by the key
+// provider and kept with the nonce in the blob metadata. Values are sealed
+// in fixed-size segments so that both directions stream.
+type EncryptedStore struct {
+	Store *Store
+	Keys  KeyProvider
+	// SegmentSize is the plaintext size of each sealed segment. Defaults to
+	// 64 KiB.
+	SegmentSize int
+	// AllowPlaintext lets Get return blobs that were stored unencrypted.
+	AllowPlaintext bool
+}
+
+// NewEncryptedStore creates an encrypting store on top of an existing store.
+func NewEncryptedStore(store *Store, keys KeyProvider) *EncryptedStore {
+	return &EncryptedStore{
+		Store:       store,
+		Keys:        keys,
+		SegmentSize: 64 << 10,
+	}
+}
+
+// segmentNonce derives the nonce of a segment from the per-blob prefix, the
+// segment counter and whether it is the final segment. Marking the final
+// segment makes truncation detectable.
+func segmentNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[7:11], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// associatedData returns the data every segment of a blob is bound to.
+// Ciphertext moved to another store or key, or paired with another
+// envelope, then fails to decrypt.
+func (e *EncryptedStore) associatedData(key string, envelope EncryptionEnvelope) []byte {
+	fields := []string{
+		e.Store.Name,
+		e.Store.storedKey(key),
+		envelope.Algorithm,
+		envelope.KeyID,
+		envelope.WrappedKey,
+		envelope.Nonce,
+		strconv.Itoa(envelope.SegmentSize),
+	}
+
+	var buf bytes.Buffer
+	for _, field := range fields {
+		binary.Write(&buf, binary.BigEndian, uint32(len(field)))
+		buf.WriteString(field)
+	}
+	return buf.Bytes()
+}
+
+// Set encrypts data and stores it under key.
+func (e *EncryptedStore) Set(key string, data io.Reader, options *SetOptions) error {
+	if options == nil {
+		options = &SetOptions{}
+	}
+
+	segmentSize := e.SegmentSize
+	if segmentSize <= 0 {
+		segmentSize = 64 << 10
+	}
+
+	dataKey := make([]byte, 32)
+	_, err := rand.Read(dataKey)
+	if err != nil {
+		return err
+	}
+
+	noncePrefix := make([]byte, 7)
+	_, err = rand.Read(noncePrefix)
+	if err != nil {
+		return err
+	}
+
+	keyID, wrapped, err := e.Keys.WrapKey(dataKey)
+	if err != nil {
+		return err
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return err
+	}
+
+	envelope := EncryptionEnvelope{
+		Algorithm:   ENCRYPTION_ALGORITHM,
+		KeyID:       keyID,
+		WrappedKey:  b64.StdEncoding.EncodeToString(wrapped),
+		Nonce:       b64.StdEncoding.EncodeToString(noncePrefix),
+		SegmentSize: segmentSize,
+	}
+	associatedData := e.associatedData(key, envelope)
+
+	metadata := options.storedMetadata()
+	metadata[ENCRYPTION_METADATA_KEY] = envelope
+
+	// The ciphertext size follows from the plaintext size, so a known
+	// length can still be streamed without buffering.
+	var size int64
+	plaintextSize := options.Size
+	if plaintextSize <= 0 {
+		plaintextSize = contentLength(data)
+	}
+	if plaintextSize >= 0 {
+		segments := (plaintextSize + int64(segmentSize) - 1) / int64(segmentSize)
+		if segments == 0 {
+			segments = 1
+		}
+		size = plaintextSize + segments*int64(aead.Overhead())
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(encryptSegments(writer, data, aead, noncePrefix, segmentSize, associatedData))
+	}()
+	defer reader.Close()
+
+	return e.Store.Set(key, reader, &SetOptions{
+		Metadata: metadata,
+		Size:     size,
+		Progress: options.Progress,
+	})
+}
+
+func encryptSegments(w io.Writer, data io.Reader, aead cipher.AEAD, noncePrefix []byte, segmentSize int, associatedData []byte) error {
+	source := bufio.NewReaderSize(data, segmentSize)
+	plaintext := make([]byte, segmentSize)
+	sealed := make([]byte, 0, segmentSize+aead.Overhead())
+
+	for counter := uint32(0); ; counter++ {
+		n, err := io.ReadFull(source, plaintext)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		last := n < segmentSize
+		if !last {
+			_, err = source.Peek(1)
+			if err == io.EOF {
+				last = true
+			} else if err != nil {
+				return err
+			}
+		}
+
+		sealed = aead.Seal(sealed[:0], segmentNonce(noncePrefix, counter, last), plaintext[:n], associatedData)
+		_, err = w.Write(sealed)
+		if err != nil {
+			return err
+		}
+
+		if last {
+			return nil
+		}
+	}
+}
+
+// Get retrieves and decrypts a value, decrypting segments as they are read.
+// It returns nil if the key does not exist.
+func (e *EncryptedStore) Get(key string) (io.ReadCloser, error) {
+	entry, err := e.GetWithMetadata(key)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	return entry.Data, nil
+}
+
+// GetWithMetadata retrieves and decrypts a value along with its ETag and
+// metadata. It returns nil if the key does not exist.
+func (e *EncryptedStore) GetWithMetadata(key string) (*GetWithMetadataResult, error) {
+	entry, err := e.Store.GetWithMetadata(key)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+
+	raw, ok := entry.Metadata[ENCRYPTION_METADATA_KEY]
+	if !ok {
+		if e.AllowPlaintext {
+			return entry, nil
+		}
+		entry.Data.Close()
+		return nil, fmt.Errorf("key %q is not encrypted", key)
+	}
+	delete(entry.Metadata, ENCRYPTION_METADATA_KEY)
+
+	aead, noncePrefix, envelope, err := e.openEnvelope(raw)
+	if err != nil {
+		entry.Data.Close()
+		return nil, fmt.Errorf("opening envelope of key %q: %w", key, err)
+	}
+
+	entry.Data = &decryptReader{
+		body:           entry.Data,
+		source:         bufio.NewReaderSize(entry.Data, envelope.SegmentSize+aead.Overhead()),
+		aead:           aead,
+		noncePrefix:    noncePrefix,
+		associatedData: e.associatedData(key, *envelope),
+		sealed:         make([]byte, envelope.SegmentSize+aead.Overhead()),
+	}
+	entry.Size = -1
+
+	return entry, nil
+}
+
+func (e *EncryptedStore) openEnvelope(raw interface{}) (cipher.AEAD, []byte, *EncryptionEnvelope, error) {
+	encoded, err := json.Marshal(raw)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var envelope EncryptionEnvelope
+	err = json.Unmarshal(encoded, &envelope)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if envelope.Algorithm != ENCRYPTION_ALGORITHM {
+		return nil, nil, nil, fmt.Errorf("unsupported algorithm %q", envelope.Algorithm)
+	}
+
+	if envelope.SegmentSize <= 0 {
+		return nil, nil, nil, fmt.Errorf("invalid segment size %d", envelope.SegmentSize)
+	}
+
+	wrapped, err := b64.StdEncoding.DecodeString(envelope.WrappedKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	noncePrefix, err := b64.StdEncoding.DecodeString(envelope.Nonce)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	dataKey, err := e.Keys.UnwrapKey(envelope.KeyID, wrapped)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return aead, noncePrefix, &envelope, nil
+}
+
+// decryptReader opens sealed segments one at a time.
+type decryptReader struct {
+	body           io.Closer
+	source         *bufio.Reader
+	aead           cipher.AEAD
+	noncePrefix    []byte
+	associatedData []byte
+	sealed         []byte
+	plaintext      []byte
+	counter        uint32
+	done           bool
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for len(r.plaintext) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+
+		n, err := io.ReadFull(r.source, r.sealed)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+
+		last := n < len(r.sealed)
+		if !last {
+			_, err = r.source.Peek(1)
+			if err == io.EOF {
+				last = true
+			} else if err != nil {
+				return 0, err
+			}
+		}
+
+		r.plaintext, err = r.aead.Open(r.sealed[:0], segmentNonce(r.noncePrefix, r.counter, last), r.sealed[:n], r.associatedData)
+		if err != nil {
+			return 0, fmt.Errorf("decrypting segment %d: %w", r.counter, err)
+		}
+
+		r.counter++
+		r.done = last
+	}
+
+	n := copy(p, r.plaintext)
+	r.plaintext = r.plaintext[n:]
+	return n, nil
+}
+
+func (r *decryptReader) Close() error {
+	return r.body.Close()
+}
+
+// Delete removes a key from the store.
+func (e *EncryptedStore) Delete(key string) error {
+	return e.Store.Delete(key)
+}
+
+// CODEC_METADATA_KEY records the compression codec a blob was written with.
+const CODEC_METADATA_KEY = "_codec"
+
+// CompressionCodec compresses and decompresses blob values.
+type CompressionCodec interface {
+	// Name identifies the codec in blob metadata.
+	Name() string
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// GzipCodec compresses values with gzip.
+type GzipCodec struct {
+	// Level is the gzip compression level. Zero uses the default level.
+	Level int
+}
+
+func (GzipCodec) Name() string {
+	return "gzip"
+}
+
+func (c GzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	level := c.Level
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	return gzip.NewWriterLevel(w, level)
+}
+
+func (GzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+var (
+	compressionCodecsMu sync.RWMutex
+	compressionCodecs   = map[string]CompressionCodec{
+		"gzip": GzipCodec{},
+	}
+)
+
+// RegisterCompressionCodec makes a codec available for decompressing blobs
+// whose metadata names it.
+func RegisterCompressionCodec(codec CompressionCodec) {
+	compressionCodecsMu.Lock()
+	defer compressionCodecsMu.Unlock()
+
+	compressionCodecs[codec.Name()] = codec
+}
+
+func lookupCompressionCodec(name string) (CompressionCodec, bool) {
+	compressionCodecsMu.RLock()
+	defer compressionCodecsMu.RUnlock()
+
+	codec, ok := compressionCodecs[name]
+	return codec, ok
+}
+
+// CompressedStore compresses values before they are stored and records the
+// codec in the blob metadata. Reads decompress according to that metadata,
+// so blobs written without compression keep reading as they are.
+type CompressedStore struct {
+	Store *Store
+	Codec CompressionCodec
+	// MinSize is the smallest value, in bytes, that is compressed. Values of
+	// known size below it are stored as they are.
+	MinSize int64
+}
+
+// NewCompressedStore creates a compressing store on top of an existing
+// store. A nil codec uses gzip.
+func NewCompressedStore(store *Store, codec CompressionCodec) *CompressedStore {
+	if codec == nil {
+		codec = GzipCodec{}
+	}
+	return &CompressedStore{
+		Store: store,
+		Codec: codec,
+	}
+}
+
+// Set compresses data and stores it under key.
+func (c *CompressedStore) Set(key string, data io.Reader, options *SetOptions) error {
+	if options == nil {
+		options = &SetOptions{}
+	}
+
+	size := options.Size
+	if size <= 0 {
+		size = contentLength(data)
+	}
+	if size >= 0 && size < c.MinSize {
+		return c.Store.Set(key, data, options)
+	}
+
+	metadata := options.storedMetadata()
+	metadata[CODEC_METADATA_KEY] = c.Codec.Name()
+
+	reader, writer := io.Pipe()
+	go func() {
+		compressor, err := c.Codec.NewWriter(writer)
+		if err == nil {
+			_, err = io.Copy(compressor, data)
+			if err == nil {
+				err = compressor.Close()
+			}
+		}
+		writer.CloseWithError(err)
+	}()
+	defer reader.Close()
+
+	return c.Store.Set(key, reader, &SetOptions{
+		Metadata: metadata,
+	})
+}
+
+// SetJSON compresses the JSON encoding of data and stores it under key.
+func (c *CompressedStore) SetJSON(key string, data interface{}, options *SetOptions) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	return c.Set(key, bytes.NewReader(payload), options)
+}
+
+// Get retrieves a value, decompressing it if needed. It returns nil if the
+// key does not exist.
+func (c *CompressedStore) Get(key string) (io.ReadCloser, error) {
+	entry, err := c.GetWithMetadata(key)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	return entry.Data, nil
+}
+
+// GetWithMetadata retrieves a value along with its ETag and metadata,
+// decompressing it if needed. It returns nil if the key does not exist.
+func (c *CompressedStore) GetWithMetadata(key string) (*GetWithMetadataResult, error) {
+	entry, err := c.Store.GetWithMetadata(key)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+
+	name, ok := entry.Metadata[CODEC_METADATA_KEY].(string)
+	if !ok {
+		return entry, nil
+	}
+	delete(entry.Metadata, CODEC_METADATA_KEY)
+
+	codec, ok := lookupCompressionCodec(name)
+	if !ok && c.Codec.Name() == name {
+		codec, ok = c.Codec, true
+	}
+	if !ok {
+		entry.Data.Close()
+		return nil, fmt.Errorf("key %q is compressed with unknown codec %q", key, name)
+	}
+
+	decompressor, err := codec.NewReader(entry.Data)
+	if err != nil {
+		entry.Data.Close()
+		return nil, err
+	}
+
+	entry.Data = struct {
+		io.Reader
+		io.Closer
+	}{decompressor, entry.Data}
+	entry.Size = -1
+
+	return entry, nil
+}
+
+// Delete removes a key from the store.
+func (c *CompressedStore) Delete(key string) error {
+	return c.Store.Delete(key)
+}
+
+// SCHEMA_VERSION_METADATA_KEY records the schema version of a typed value.
+const SCHEMA_VERSION_METADATA_KEY = "_schema_version"
+
+// ValueCodec serializes the values of a TypedStore.
+type ValueCodec[T any] interface {
+	Marshal(value T) ([]byte, error)
+	Unmarshal(data []byte, value *T) error
+}
+
+// JSONCodec serializes values as JSON.
+type JSONCodec[T any] struct{}
+
+func (JSONCodec[T]) Marshal(value T) ([]byte, error) {
+	return json.Marshal(value)
+}
+
+func (JSONCodec[T]) Unmarshal(data []byte, value *T) error {
+	return json.Unmarshal(data, value)
+}
+
+// GobCodec serializes values with encoding/gob.
+type GobCodec[T any] struct{}
+
+func (GobCodec[T]) Marshal(value T) ([]byte, error) {
+	var buffer bytes.Buffer
+	err := gob.NewEncoder(&buffer).Encode(value)
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (GobCodec[T]) Unmarshal(data []byte, value *T) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(value)
+}
+
+// BytesCodec stores byte slices as they are.
+type BytesCodec struct{}
+
+func (BytesCodec) Marshal(value []byte) ([]byte, error) {
+	return value, nil
+}
+
+func (BytesCodec) Unmarshal(data []byte, value *[]byte) error {
+	*value = data
+	return nil
+}
+
+// TextCodec stores strings as UTF-8 text.
+type TextCodec struct{}
+
+func (TextCodec) Marshal(value string) ([]byte, error) {
+	return []byte(value), nil
+}
+
+func (TextCodec) Unmarshal(data []byte, value *string) error {
+	*value = string(data)
+	return nil
+}
+
+// SchemaUpgrade converts a serialized value from one schema version to the
+// next.
+type SchemaUpgrade func(data []byte) ([]byte, error)
+
+// TypedStore stores values of type T using a codec. Each value is stamped
+// with the store's schema version, and values written at older versions are
+// passed through the upgrade hooks when they are read.
+type TypedStore[T any] struct {
+	Store *Store
+	Codec ValueCodec[T]
+	// SchemaVersion is stamped into the metadata of every value written.
+	SchemaVersion int
+	// Upgrades maps a schema version to the hook that converts values
+	// written at that version to the next one.
+	Upgrades map[int]SchemaUpgrade
+}
+
+// NewTypedStore creates a typed store on top of an existing store.
+func NewTypedStore[T any](store *Store, codec ValueCodec[T]) *TypedStore[T] {
+	return &TypedStore[T]{
+		Store:    store,
+		Codec:    codec,
+		Upgrades: map[int]SchemaUpgrade{},
+	}
+}
+
+// Get retrieves and decodes the value stored under key. The boolean result
+// is false if the key does not exist.
+func (t *TypedStore[T]) Get(key string) (T, bool, error) {
+	var value T
+
+	entry, err := t.Store.GetWithMetadata(key)
+	if err != nil || entry == nil {
+		return value, false, err
+	}
+	defer entry.Data.Close()
+
+	data, err := io.ReadAll(entry.Data)
+	if err != nil {
+		return value, false, err
+	}
+
+	data, err = t.upgrade(key, entry.Metadata, data)
+	if err != nil {
+		return value, false, err
+	}
+
+	err = t.Codec.Unmarshal(data, &value)
+	if err != nil {
+		return value, false, fmt.Errorf("decoding key %q: %w", key, err)
+	}
+
+	return value, true, nil
+}
+
+func (t *TypedStore[T]) upgrade(key string, metadata Metadata, data []byte) ([]byte, error) {
+	version := 0
+	if stamped, ok := metadata[SCHEMA_VERSION_METADATA_KEY].(float64); ok {
+		version = int(stamped)
+	}
+
+	if version > t.SchemaVersion {
+		return nil, fmt.Errorf("key %q has schema version %d, newer than %d", key, version, t.SchemaVersion)
+	}
+
+	for ; version < t.SchemaVersion; version++ {
+		upgrade, ok := t.Upgrades[version]
+		if !ok {
+			return nil, fmt.Errorf("no upgrade from schema version %d for key %q", version, key)
+		}
+
+		var err error
+		data, err = upgrade(data)
+		if err != nil {
+			return nil, fmt.Errorf("upgrading key %q from schema version %d: %w", key, version, err)
+		}
+	}
+
+	return data, nil
+}
+
+// Set encodes value and stores it under key.
+func (t *TypedStore[T]) Set(key string, value T, options *SetOptions) error {
+	if options == nil {
+		options = &SetOptions{}
+	}
+
+	data, err := t.Codec.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("encoding key %q: %w", key, err)
+	}
+
+	metadata := options.storedMetadata()
+	metadata[SCHEMA_VERSION_METADATA_KEY] = t.SchemaVersion
+
+	return t.Store.Set(key, bytes.NewReader(data), &SetOptions{
+		Metadata: metadata,
+	})
+}
+
+// Delete removes a key from the store.
+func (t *TypedStore[T]) Delete(key string) error {
+	return t.Store.Delete(key)
+}
+
+// Each calls fn with every key under prefix and its decoded value. Keys
+// deleted while iterating are skipped, and iteration stops at the first
+// error.
+func (t *TypedStore[T]) Each(prefix string, fn func(key string, value T) error) error {
+	return t.Store.ListPages(&ListOptions{Prefix: prefix}, func(page *ListResult) error {
+		for _, blob := range page.Blobs {
+			value, ok, err := t.Get(blob.Key)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+
+			err = fn(blob.Key, value)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// BufferedWriterOptions represents options for a BufferedWriter.
+type BufferedWriterOptions struct {
+	// Concurrency is the number of uploads run in parallel by Flush.
+	// Defaults to 8.
+	Concurrency int
+}
+
+// BufferedWriter queues writes to a store and uploads them when Flush is
+// called. Repeated writes to the same key are coalesced, so only the last
+// one is uploaded. Lambda handlers should call Flush before returning,
+// since queued writes are lost once the invocation ends.
+type BufferedWriter struct {
+	store       *Store
+	concurrency int
+
+	mu      sync.Mutex
+	pending map[string]*pendingWrite
+	order   []string
+}
+
+type pendingWrite struct {
+	data     []byte
+	delete   bool
+	options  *SetOptions
+	sequence int64
+}
+
+// Buffered returns a writer that queues writes to the store.
+func (s *Store) Buffered(options *BufferedWriterOptions) *BufferedWriter {
+	concurrency := 8
+	if options != nil && options.Concurrency > 0 {
+		concurrency = options.Concurrency
+	}
+
+	return &BufferedWriter{
+		store:       s,
+		concurrency: concurrency,
+		pending:     map[string]*pendingWrite{},
+	}
+}
+
+var bufferedWriteSequence int64
+
+func (b *BufferedWriter) enqueue(key string, write *pendingWrite) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	write.sequence = atomic.AddInt64(&bufferedWriteSequence, 1)
+	if _, ok := b.pending[key]; !ok {
+		b.order = append(b.order, key)
+	}
+	b.pending[key] = write
+}
+
+// Set queues data to be stored under key. The data is copied, so the
+// caller may reuse the slice.
+func (b *BufferedWriter) Set(key string, data []byte, options *SetOptions) error {
+	err := b.store.checkKey(key)
+	if err != nil {
+		return err
+	}
+
+	b.enqueue(key, &pendingWrite{
+		data:    append([]byte(nil), data...),
+		options: options,
+	})
+	return nil
+}
+
+// SetJSON queues the JSON encoding of data to be stored under key.
+func (b *BufferedWriter) SetJSON(key string, data interface{}, options *SetOptions) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	return b.Set(key, payload, options)
+}
+
+// Delete queues the removal of key, replacing any write queued for it.
+func (b *BufferedWriter) Delete(key string) {
+	b.enqueue(key, &pendingWrite{
+		delete: true,
+	})
+}
+
+// Pending returns the number of keys waiting to be flushed.
+func (b *BufferedWriter) Pending() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.pending)
+}
+
+// FlushError reports the keys that could not be written by Flush.
+type FlushError struct {
+	Errors map[string]error
+}
+
+func (e *FlushError) Error() string {
+	keys := make([]string, 0, len(e.Errors))
+	for key := range e.Errors {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return fmt.Sprintf("failed to flush %d keys, first %q: %v", len(keys), keys[0], e.Errors[keys[0]])
+}
+
+// Flush uploads every queued write with bounded concurrency. Writes that
+// fail stay queued, unless a newer write to the same key has been queued in
+// the meantime, and are reported through a FlushError.
+func (b *BufferedWriter) Flush(ctx context.Context) error {
+	b.mu.Lock()
+	keys := b.order
+	writes := b.pending
+	b.order = nil
+	b.pending = map[string]*pendingWrite{}
+	b.mu.Unlock()
+
+	errs := runBatch(ctx, len(keys), b.concurrency, func(ctx context.Context, i int) error {
+		write := writes[keys[i]]
+		if write.delete {
+			return b.store.delete(ctx, keys[i], "")
+		}
+		_, err := b.store.set(ctx, keys[i], bytes.NewReader(write.data), write.options)
+		return err
+	})
+
+	failed := map[string]error{}
+	for i, key := range keys {
+		if errs[i] != nil {
+			failed[key] = errs[i]
+		}
+	}
+
+	if len(failed) == 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	for key := range failed {
+		if newer, ok := b.pending[key]; ok && newer.sequence > writes[key].sequence {
+			continue
+		}
+		if _, ok := b.pending[key]; !ok {
+			b.order = append(b.order, key)
+		}
+		b.pending[key] = writes[key]
+	}
+	b.mu.Unlock()
+
+	return &FlushError{Errors: failed}
+}
+
+// runBatch calls fn for every index in [0, n) with at most limit running at
+// once and returns the error of each call. Unlike forEachConcurrent, a
+// failure does not stop the batch. Calls never started because ctx ended
+// report the context error.
+func runBatch(ctx context.Context, n int, limit int, fn func(ctx context.Context, i int) error) []error {
+	errs := make([]error, n)
+	attempted := make([]bool, n)
+
+	err := forEachConcurrent(ctx, n, limit, func(ctx context.Context, i int) error {
+		attempted[i] = true
+		errs[i] = fn(ctx, i)
+		return nil
+	})
+
+	for i := range errs {
+		if !attempted[i] {
+			errs[i] = err
+		}
+	}
+
+	return errs
+}
+
+// BatchOptions represents options for batch operations.
+type BatchOptions struct {
+	// Concurrency is the number of requests run in parallel. Defaults to 8.
+	Concurrency int
+	// Prefix, for DeleteMany, also deletes every key that starts with it.
+	Prefix string
+}
+
+func (o *BatchOptions) concurrency() int {
+	if o == nil || o.Concurrency <= 0 {
+		return 8
+	}
+	return o.Concurrency
+}
+
+// BatchGetResult represents the outcome of one key in GetMany.
+type BatchGetResult struct {
+	Key      string
+	Data     []byte
+	ETag     string
+	Metadata Metadata
+	// Found is false if the key does not exist.
+	Found bool
+	Err   error
+}
+
+// BatchSetItem represents one write in SetMany.
+type BatchSetItem struct {
+	Key     string
+	Data    []byte
+	Options *SetOptions
+}
+
+// BatchResult represents the outcome of one key in SetMany or DeleteMany.
+type BatchResult struct {
+	Key string
+	Err error
+}
+
+// GetMany retrieves several keys in parallel. Results are returned in the
+// order of keys, each with its own error.
+func (s *Store) GetMany(ctx context.Context, keys []string, options *BatchOptions) []BatchGetResult {
+	results := make([]BatchGetResult, len(keys))
+
+	errs := runBatch(ctx, len(keys), options.concurrency(), func(ctx context.Context, i int) error {
+		results[i].Key = keys[i]
+
+		entry, err := s.getWithMetadata(ctx, keys[i])
+		if err != nil || entry == nil {
+			return err
+		}
+		defer entry.Data.Close()
+
+		data, err := io.ReadAll(entry.Data)
+		if err != nil {
+			return err
+		}
+
+		results[i].Data = data
+		results[i].ETag = entry.ETag
+		results[i].Metadata = entry.Metadata
+		results[i].Found = true
+		return nil
+	})
+
+	for i, err := range errs {
+		results[i].Key = keys[i]
+		results[i].Err = err
+	}
+
+	return results
+}
+
+// SetMany writes several keys in parallel. Results are returned in the
+// order of items, each with its own error.
+func (s *Store) SetMany(ctx context.Context, items []BatchSetItem, options *BatchOptions) []BatchResult {
+	errs := runBatch(ctx, len(items), options.concurrency(), func(ctx context.Context, i int) error {
+		_, err := s.set(ctx, items[i].Key, bytes.NewReader(items[i].Data), items[i].Options)
+		return err
+	})
+
+	results := make([]BatchResult, len(items))
+	for i, err := range errs {
+		results[i] = BatchResult{Key: items[i].Key, Err: err}
+	}
+
+	return results
+}
+
+// DeleteMany deletes several keys in parallel, along with every key under
+// BatchOptions.Prefix when it is set. Results are returned for each key
+// deleted, explicit keys first. The error is only set if the prefix could
+// not be listed.
+func (s *Store) DeleteMany(ctx context.Context, keys []string, options *BatchOptions) ([]BatchResult, error) {
+	keys = append([]string(nil), keys...)
+
+	if options != nil && options.Prefix != "" {
+		err := s.ListPages(&ListOptions{Prefix: options.Prefix}, func(page *ListResult) error {
+			for _, blob := range page.Blobs {
+				keys = append(keys, blob.Key)
+			}
+			return ctx.Err()
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	errs := runBatch(ctx, len(keys), options.concurrency(), func(ctx context.Context, i int) error {
+		return s.delete(ctx, keys[i], "")
+	})
+
+	results := make([]BatchResult, len(keys))
+	for i, err := range errs {
+		results[i] = BatchResult{Key: keys[i], Err: err}
+	}
+
+	return results, nil
+}
+
+// SweepOptions represents options for SweepExpired.
+type SweepOptions struct {
+	// Prefix limits the sweep to keys that start with it.
+	Prefix string
+	// BatchSize is the number of expired keys deleted at a time. Defaults
+	// to 100.
+	BatchSize int
+	// Concurrency is the number of requests run in parallel. Defaults to 8.
+	Concurrency int
+}
+
+// SweepResult represents the outcome of a sweep.
+type SweepResult struct {
+	Scanned int
+	Deleted int
+}
+
+// SweepExpired lists the store and deletes keys whose expiry has passed.
+// Listings carry no metadata, so every key is inspected with a HEAD
+// request.
+func (s *Store) SweepExpired(ctx context.Context, options *SweepOptions) (*SweepResult, error) {
+	if options == nil {
+		options = &SweepOptions{}
+	}
+
+	batchSize := options.BatchSize
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+
+	batchOptions := &BatchOptions{Concurrency: options.Concurrency}
+	result := &SweepResult{}
+	expired := []ListResultBlob{}
+
+	err := s.ListPages(&ListOptions{Prefix: options.Prefix}, func(page *ListResult) error {
+		now := time.Now()
+		flags := make([]bool, len(page.Blobs))
+		etags := make([]string, len(page.Blobs))
+
+		errs := runBatch(ctx, len(page.Blobs), batchOptions.concurrency(), func(ctx context.Context, i int) error {
+			res, err := s.getIncludingExpired(ctx, page.Blobs[i].Key, HTTPMethodHead, map[string]string{})
+			if err != nil || res == nil {
+				return err
+			}
+			res.Body.Close()
+
+			metadata, err := getMetadataFromResponse(res)
+			if err != nil {
+				return err
+			}
+			flags[i] = isExpired(metadata, now)
+			etags[i] = res.Header.Get("etag")
+			return nil
+		})
+
+		for i, blob := range page.Blobs {
+			if errs[i] != nil {
+				return fmt.Errorf("inspecting key %q: %w", blob.Key, errs[i])
+			}
+			result.Scanned++
+			if flags[i] {
+				expired = append(expired, ListResultBlob{Key: blob.Key, ETag: etags[i]})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+
+	// Deleting only once the listing is complete keeps the pagination
+	// cursor stable. Each delete is conditional on the ETag that was
+	// inspected, so keys rewritten since are kept.
+	for start := 0; start < len(expired); start += batchSize {
+		end := start + batchSize
+		if end > len(expired) {
+			end = len(expired)
+		}
+		batch := expired[start:end]
+
+		deleted := make([]bool, len(batch))
+		errs := runBatch(ctx, len(batch), batchOptions.concurrency(), func(ctx context.Context, i int) error {
+			err := s.delete(ctx, batch[i].Key, batch[i].ETag)
+
+			var preconditionError *BlobsPreconditionError
+			if errors.As(err, &preconditionError) {
+				return nil
+			}
+			deleted[i] = err == nil
+			return err
+		})
+
+		for i, err := range errs {
+			if err != nil {
+				return result, fmt.Errorf("deleting key %q: %w", batch[i].Key, err)
+			}
+			if deleted[i] {
+				result.Deleted++
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// UPDATE_MAX_ATTEMPTS bounds the number of times Update retries a write
+// that lost a race.
+const UPDATE_MAX_ATTEMPTS = 32
+
+// Update atomically replaces the value of key with the result of fn. The
+// write is conditional on the ETag that was read, and is retried with
+// backoff whenever another writer got there first, so fn may be called
+// several times. fn receives nil if the key does not exist. Existing
+// metadata is kept. It returns the value that was written.
+func (s *Store) Update(ctx context.Context, key string, fn func(old []byte) ([]byte, error)) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		old, etag, metadata, err := s.readForUpdate(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := fn(old)
+		if err != nil {
+			return nil, err
+		}
+
+		options := &SetOptions{
+			Metadata:    metadata,
+			OnlyIfMatch: etag,
+			OnlyIfNew:   etag == "",
+		}
+
+		_, err = s.set(ctx, key, bytes.NewReader(value), options)
+		if err == nil {
+			return value, nil
+		}
+
+		var preconditionError *BlobsPreconditionError
+		if !errors.As(err, &preconditionError) || attempt+1 >= UPDATE_MAX_ATTEMPTS {
+			return nil, err
+		}
+
+		err = sleepWithBackoff(ctx, attempt)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readForUpdate reads a key bypassing the cache. Expired blobs still report
+// their ETag, so a conditional write can replace them, but their value and
+// expiry are dropped.
+func (s *Store) readForUpdate(ctx context.Context, key string) ([]byte, string, Metadata, error) {
+	res, err := s.getIncludingExpired(ctx, key, HTTPMethodGet, map[string]string{})
+	if err != nil || res == nil {
+		return nil, "", nil, err
+	}
+	defer res.Body.Close()
+
+	metadata, err := getMetadataFromResponse(res)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	etag := res.Header.Get("etag")
+
+	if isExpired(metadata, time.Now()) {
+		delete(metadata, EXPIRES_AT_METADATA_KEY)
+		return nil, etag, metadata, nil
+	}
+
+	value, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, "", nil, err
+	}
+
+	return value, etag, metadata, nil
+}
+
+// sleepWithBackoff waits an exponentially growing, jittered delay for the
+// given attempt, returning early if ctx ends.
+func sleepWithBackoff(ctx context.Context, attempt int) error {
+	delay := 10 * time.Millisecond << uint(attempt)
+	if delay > time.Second || delay <= 0 {
+		delay = time.Second
+	}
+	delay = delay/2 + time.Duration(mathrand.Int63n(int64(delay/2)+1))
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
+
+// Incr atomically adds delta to the integer counter stored under key and
+// returns the new value. A missing key counts from zero.
+func (s *Store) Incr(ctx context.Context, key string, delta int64) (int64, error) {
+	var counter int64
+
+	_, err := s.Update(ctx, key, func(old []byte) ([]byte, error) {
+		counter = 0
+		if len(old) > 0 {
+			current, err := strconv.ParseInt(strings.TrimSpace(string(old)), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("key %q does not hold an integer counter: %w", key, err)
+			}
+			counter = current
+		}
+
+		counter += delta
+		return []byte(strconv.FormatInt(counter, 10)), nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return counter, nil
+}
+
+// Decr atomically subtracts delta from the integer counter stored under key
+// and returns the new value.
+func (s *Store) Decr(ctx context.Context, key string, delta int64) (int64, error) {
+	return s.Incr(ctx, key, -delta)
+}
+
+// Metadata keys holding the state of a lease.
+const (
+	LOCK_OWNER_METADATA_KEY      = "_lock_owner"
+	LOCK_TOKEN_METADATA_KEY      = "_lock_token"
+	LOCK_EXPIRES_AT_METADATA_KEY = "_lock_expires_at"
+)
+
+// LockTimeoutError is returned when a lock could not be acquired in time.
+type LockTimeoutError struct {
+	Key     string
+	Message string
+}
+
+func (e *LockTimeoutError) Error() string {
+	return e.Message
+}
+
+func NewLockTimeoutError(key string) *LockTimeoutError {
+	return &LockTimeoutError{
+		Key:     key,
+		Message: fmt.Sprintf("timed out acquiring lock %q", key),
+	}
+}
+
+// LockLostError is returned when a lease was taken over by another owner,
+// typically because it expired before it was renewed.
+type LockLostError struct {
+	Key     string
+	Message string
+}
+
+func (e *LockLostError) Error() string {
+	return e.Message
+}
+
+func NewLockLostError(key string) *LockLostError {
+	return &LockLostError{
+		Key:     key,
+		Message: fmt.Sprintf("lock %q is no longer held", key),
+	}
+}
+
+// Lock is a lease on a store key. The lease is created with a create-only
+// write and kept in the blob metadata with its owner, expiry and a fencing
+// token. Leases that expired can be stolen, and every acquisition
+// increments the token, so writes guarded by a stale holder can be
+// rejected by comparing tokens.
+type Lock struct {
+	Store *Store
+	Key   string
+	Owner string
+	TTL   time.Duration
+
+	mu    sync.Mutex
+	etag  string
+	token int64
+}
+
+// NewLock creates a lock on key with the given lease duration. An empty
+// owner is replaced with a random ID.
+func NewLock(store *Store, key string, owner string, ttl time.Duration) (*Lock, error) {
+	err := store.checkKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if owner == "" {
+		id := make([]byte, 8)
+		_, err := rand.Read(id)
+		if err != nil {
+			return nil, err
+		}
+		owner = hex.EncodeToString(id)
+	}
+
+	return &Lock{
+		Store: store,
+		Key:   key,
+		Owner: owner,
+		TTL:   ttl,
+	}, nil
+}
+
+// lockState reads the current lease, returning a zero token and an empty
+// ETag if the lock has never been taken.
+func (l *Lock) lockState(ctx context.Context) (string, string, int64, time.Time, error) {
+	res, err := l.Store.getIncludingExpired(ctx, l.Key, HTTPMethodHead, map[string]string{})
+	if err != nil || res == nil {
+		return "", "", 0, time.Time{}, err
+	}
+	res.Body.Close()
+
+	metadata, err := getMetadataFromResponse(res)
+	if err != nil {
+		return "", "", 0, time.Time{}, err
+	}
+
+	owner, _ := metadata[LOCK_OWNER_METADATA_KEY].(string)
+	token, _ := metadata[LOCK_TOKEN_METADATA_KEY].(float64)
+	expiresAt, _ := metadata[LOCK_EXPIRES_AT_METADATA_KEY].(float64)
+
+	return res.Header.Get("etag"), owner, int64(token), time.UnixMilli(int64(expiresAt)), nil
+}
+
+// writeLease writes the lease conditionally on etag, or create-only if etag
+// is empty, and records the resulting ETag.
+func (l *Lock) writeLease(ctx context.Context, etag string, owner string, token int64, expiresAt time.Time) error {
+	newETag, err := l.Store.set(ctx, l.Key, http.NoBody, &SetOptions{
+		Metadata: Metadata{
+			LOCK_OWNER_METADATA_KEY:      owner,
+			LOCK_TOKEN_METADATA_KEY:      token,
+			LOCK_EXPIRES_AT_METADATA_KEY: expiresAt.UnixMilli(),
+		},
+		OnlyIfMatch: etag,
+		OnlyIfNew:   etag == "",
+	})
+	if err != nil {
+		return err
+	}
+
+	// Fall back to reading the ETag back when the write did not report it.
+	if newETag == "" {
+		var current string
+		var currentToken int64
+		newETag, current, currentToken, _, err = l.lockState(ctx)
+		if err != nil {
+			return err
+		}
+		if current != owner || currentToken != token {
+			return NewLockLostError(l.Key)
+		}
+	}
+
+	l.etag = newETag
+	return nil
+}
+
+// TryAcquire makes a single attempt to take the lock, stealing the lease
+// if it has expired. It reports whether the lock is now held.
+func (l *Lock) TryAcquire(ctx context.Context) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	etag, owner, token, expiresAt, err := l.lockState(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	if etag != "" && owner != "" && owner != l.Owner && time.Now().Before(expiresAt) {
+		return false, nil
+	}
+
+	// Taking over our own live lease keeps its token.
+	next := token + 1
+	if owner == l.Owner && time.Now().Before(expiresAt) {
+		next = token
+	}
+
+	err = l.writeLease(ctx, etag, l.Owner, next, time.Now().Add(l.TTL))
+
+	var preconditionError *BlobsPreconditionError
+	if errors.As(err, &preconditionError) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	l.token = next
+	return true, nil
+}
+
+// Acquire waits until the lock is taken, failing with a LockTimeoutError
+// once timeout has passed.
+func (l *Lock) Acquire(ctx context.Context, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for attempt := 0; ; attempt++ {
+		acquired, err := l.TryAcquire(ctx)
+		if err != nil && ctx.Err() == nil {
+			return err
+		}
+		if acquired {
+			return nil
+		}
+
+		if ctx.Err() != nil || sleepWithBackoff(ctx, attempt) != nil {
+			return NewLockTimeoutError(l.Key)
+		}
+	}
+}
+
+// Renew extends the lease by the lock TTL. It fails with a LockLostError if
+// the lease was taken over.
+func (l *Lock) Renew(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.etag == "" {
+		return NewLockLostError(l.Key)
+	}
+
+	err := l.writeLease(ctx, l.etag, l.Owner, l.token, time.Now().Add(l.TTL))
+
+	var preconditionError *BlobsPreconditionError
+	if errors.As(err, &preconditionError) {
+		l.etag = ""
+		return NewLockLostError(l.Key)
+	}
+	return err
+}
+
+// Release gives up the lease. The lock blob is kept rather than deleted so
+// that fencing tokens keep increasing across holders.
+func (l *Lock) Release(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.etag == "" {
+		return NewLockLostError(l.Key)
+	}
+
+	err := l.writeLease(ctx, l.etag, "", l.token, time.UnixMilli(0))
+	l.etag = ""
+
+	var preconditionError *BlobsPreconditionError
+	if errors.As(err, &preconditionError) {
+		return NewLockLostError(l.Key)
+	}
+	return err
+}
+
+// Token returns the fencing token of the current lease.
+func (l *Lock) Token() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.token
+}
+
+// Metadata keys holding the state of a queued job.
+const (
+	JOB_VISIBLE_AT_METADATA_KEY = "_job_visible_at"
+	JOB_ATTEMPTS_METADATA_KEY   = "_job_attempts"
+)
+
+// Queue is a durable work queue in which each job is a blob under Prefix.
+// Claiming a job hides it for the visibility timeout with a write
+// conditional on its ETag, so only one worker can claim it. Jobs that are
+// not acknowledged in time become visible again, and jobs that fail too
+// often are moved under DeadLetterPrefix.
+type Queue struct {
+	Store            *Store
+	Prefix           string
+	DeadLetterPrefix string
+	// VisibilityTimeout is how long a claimed job stays hidden. Defaults to
+	// 30 seconds.
+	VisibilityTimeout time.Duration
+	// MaxAttempts is the number of claims after which a failed job is
+	// dead-lettered. Defaults to 5.
+	MaxAttempts int
+}
+
+// NewQueue creates a queue that keeps jobs under queue/ and dead-lettered
+// jobs under dead/.
+func NewQueue(store *Store) *Queue {
+	return &Queue{
+		Store:             store,
+		Prefix:            "queue/",
+		DeadLetterPrefix:  "dead/",
+		VisibilityTimeout: DEFAULT_VISIBILITY_TIMEOUT,
+		MaxAttempts:       DEFAULT_MAX_ATTEMPTS,
+	}
+}
+
+// Defaults used when VisibilityTimeout or MaxAttempts is not set.
+const (
+	DEFAULT_VISIBILITY_TIMEOUT = 30 * time.Second
+	DEFAULT_MAX_ATTEMPTS       = 5
+)
+
+func (q *Queue) visibilityTimeout() time.Duration {
+	if q.VisibilityTimeout <= 0 {
+		return DEFAULT_VISIBILITY_TIMEOUT
+	}
+	return q.VisibilityTimeout
+}
+
+func (q *Queue) maxAttempts() int {
+	if q.MaxAttempts <= 0 {
+		return DEFAULT_MAX_ATTEMPTS
+	}
+	return q.MaxAttempts
+}
+
+// Job represents a claimed job.
+type Job struct {
+	ID       string
+	Payload  []byte
+	Attempts int
+
+	etag string
+}
+
+func jobMetadata(visibleAt time.Time, attempts int) Metadata {
+	return Metadata{
+		JOB_VISIBLE_AT_METADATA_KEY: visibleAt.UnixMilli(),
+		JOB_ATTEMPTS_METADATA_KEY:   attempts,
+	}
+}
+
+// Enqueue adds a job and returns its ID. IDs sort by enqueue time, so jobs
+// are claimed roughly in order.
+func (q *Queue) Enqueue(ctx context.Context, payload []byte) (string, error) {
+	id, err := newUploadID()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = q.Store.set(ctx, q.Prefix+id, bytes.NewReader(payload), &SetOptions{
+		Metadata:  jobMetadata(time.Now(), 0),
+		OnlyIfNew: true,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+// Claim takes the oldest visible job and hides it for the visibility
+// timeout. It returns nil if no job is available.
+func (q *Queue) Claim(ctx context.Context) (*Job, error) {
+	listing, err := q.Store.List(&ListOptions{Prefix: q.Prefix})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(listing.Blobs, func(i, j int) bool {
+		return listing.Blobs[i].Key < listing.Blobs[j].Key
+	})
+
+	for _, blob := range listing.Blobs {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		job, err := q.tryClaim(ctx, blob.Key)
+		if err != nil {
+			return nil, err
+		}
+		if job != nil {
+			return job, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (q *Queue) tryClaim(ctx context.Context, key string) (*Job, error) {
+	res, err := q.Store.getIncludingExpired(ctx, key, HTTPMethodGet, map[string]string{})
+	if err != nil || res == nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	metadata, err := getMetadataFromResponse(res)
+	if err != nil {
+		return nil, err
+	}
+
+	visibleAt, _ := metadata[JOB_VISIBLE_AT_METADATA_KEY].(float64)
+	if time.Now().UnixMilli() < int64(visibleAt) {
+		return nil, nil
+	}
+
+	payload, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	attempts, _ := metadata[JOB_ATTEMPTS_METADATA_KEY].(float64)
+	job := &Job{
+		ID:       strings.TrimPrefix(key, q.Prefix),
+		Payload:  payload,
+		Attempts: int(attempts) + 1,
+	}
+
+	job.etag, err = q.Store.set(ctx, key, bytes.NewReader(payload), &SetOptions{
+		Metadata:    jobMetadata(time.Now().Add(q.visibilityTimeout()), job.Attempts),
+		OnlyIfMatch: res.Header.Get("etag"),
+	})
+
+	// Another worker claimed the job first.
+	var preconditionError *BlobsPreconditionError
+	if errors.As(err, &preconditionError) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return job, nil
+}
+
+// checkClaim fails with a BlobsPreconditionError if the job has been
+// claimed again since it was handed out, for example because it outlived
+// its visibility timeout.
+func (q *Queue) checkClaim(ctx context.Context, job *Job) error {
+	key := q.Prefix + job.ID
+
+	res, err := q.Store.getIncludingExpired(ctx, key, HTTPMethodHead, map[string]string{})
+	if err != nil {
+		return err
+	}
+	if res == nil {
+		return NewBlobsPreconditionError(key)
+	}
+	res.Body.Close()
+
+	if job.etag != "" && res.Header.Get("etag") != job.etag {
+		return NewBlobsPreconditionError(key)
+	}
+	return nil
+}
+
+// Ack removes a job once it has been processed. The delete is conditional
+// on the claim, so a job another worker has reclaimed in the meantime is
+// left alone.
+func (q *Queue) Ack(ctx context.Context, job *Job) error {
+	err := q.checkClaim(ctx, job)
+	if err != nil {
+		return err
+	}
+
+	return q.Store.delete(ctx, q.Prefix+job.ID, job.etag)
+}
+
+// Nack returns a job to the queue, to become visible again after delay.
+// Jobs that have used up their attempts are moved to the dead-letter
+// prefix instead.
+func (q *Queue) Nack(ctx context.Context, job *Job, delay time.Duration) error {
+	key := q.Prefix + job.ID
+
+	if job.Attempts >= q.maxAttempts() {
+		err := q.checkClaim(ctx, job)
+		if err != nil {
+			return err
+		}
+
+		_, err = q.Store.set(ctx, q.DeadLetterPrefix+job.ID, bytes.NewReader(job.Payload), &SetOptions{
+			Metadata: jobMetadata(time.Now(), job.Attempts),
+		})
+		if err != nil {
+			return err
+		}
+
+		err = q.Store.delete(ctx, key, job.etag)
+		if err != nil {
+			// The job was reclaimed, so it is not dead yet.
+			q.Store.delete(ctx, q.DeadLetterPrefix+job.ID, "")
+			return err
+		}
+		return nil
+	}
+
+	etag, err := q.Store.set(ctx, key, bytes.NewReader(job.Payload), &SetOptions{
+		Metadata:    jobMetadata(time.Now().Add(delay), job.Attempts),
+		OnlyIfMatch: job.etag,
+	})
+	if err != nil {
+		return err
+	}
+
+	job.etag = etag
+	return nil
+}
+
+// WorkerOptions represents options for Queue.Run.
+type WorkerOptions struct {
+	// PollInterval is how long to wait when the queue is empty. Defaults to
+	// one second.
+	PollInterval time.Duration
+	// StopBefore is how long before the context deadline the worker stops
+	// claiming jobs. Defaults to the visibility timeout, so a claimed job
+	// can finish before the invocation ends.
+	StopBefore time.Duration
+	// RetryDelay is the base delay before a failed job is retried. It
+	// doubles with every attempt. Defaults to one second.
+	RetryDelay time.Duration
+}
+
+// Run claims and handles jobs until ctx is done, or until its deadline is
+// near, so a scheduled function can drain the queue within its time limit.
+// Jobs are acknowledged when handle succeeds and retried with backoff when
+// it fails. Each job is handled with a context bounded by the visibility
+// timeout.
+func (q *Queue) Run(ctx context.Context, handle func(ctx context.Context, job *Job) error, options *WorkerOptions) error {
+	if options == nil {
+		options = &WorkerOptions{}
+	}
+
+	pollInterval := options.PollInterval
+	if pollInterval <= 0 {
+		pollInterval = time.Second
+	}
+
+	stopBefore := options.StopBefore
+	if stopBefore <= 0 {
+		stopBefore = q.visibilityTimeout()
+	}
+
+	retryDelay := options.RetryDelay
+	if retryDelay <= 0 {
+		retryDelay = time.Second
+	}
+
+	for {
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < stopBefore {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		job, err := q.Claim(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		if job == nil {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(pollInterval):
+			}
+			continue
+		}
+
+		jobCtx, cancel := context.WithTimeout(ctx, q.visibilityTimeout())
+		err = handle(jobCtx, job)
+		cancel()
+
+		if err == nil {
+			err = q.Ack(ctx, job)
+		} else {
+			err = q.Nack(ctx, job, retryDelay<<uint(job.Attempts-1))
+		}
+
+		// Losing a job to another worker after its visibility timeout is
+		// not fatal to the loop.
+		var preconditionError *BlobsPreconditionError
+		if err != nil && !errors.As(err, &preconditionError) && ctx.Err() == nil {
+			return err
+		}
+	}
+}
+
+// EventLog is an append-only log of events stored in segment blobs whose
+// keys sort in append order. Each segment holds newline-delimited JSON. A
+// segment is sealed once it reaches SegmentSize and the next one is created
+// with a create-only write, so concurrent appenders agree on where each
+// event goes.
+type EventLog struct {
+	Store  *Store
+	Prefix string
+	// SegmentSize is the size at which a segment is sealed. Defaults to
+	// 1 MiB. The event that crosses it is kept in the sealed segment.
+	SegmentSize int64
+}
+
+// NewEventLog creates an event log under prefix.
+func NewEventLog(store *Store, prefix string) *EventLog {
+	return &EventLog{
+		Store:       store,
+		Prefix:      prefix,
+		SegmentSize: DEFAULT_EVENT_SEGMENT_SIZE,
+	}
+}
+
+// DEFAULT_EVENT_SEGMENT_SIZE is the segment size used when SegmentSize is
+// not set.
+const DEFAULT_EVENT_SEGMENT_SIZE = 1 << 20
+
+func (l *EventLog) segmentSize() int64 {
+	if l.SegmentSize <= 0 {
+		return DEFAULT_EVENT_SEGMENT_SIZE
+	}
+	return l.SegmentSize
+}
+
+// EventCursor is a position in an event log: a segment number and the
+// index of an event within it.
+type EventCursor struct {
+	Segment int64 `json:"segment"`
+	Offset  int   `json:"offset"`
+}
+
+// String encodes the cursor so it can be persisted.
+func (c EventCursor) String() string {
+	return fmt.Sprintf("%d:%d", c.Segment, c.Offset)
+}
+
+// ParseEventCursor decodes a cursor produced by EventCursor.String.
+func ParseEventCursor(value string) (EventCursor, error) {
+	var cursor EventCursor
+	_, err := fmt.Sscanf(value, "%d:%d", &cursor.Segment, &cursor.Offset)
+	if err != nil {
+		return EventCursor{}, fmt.Errorf("invalid event cursor %q", value)
+	}
+	return cursor, nil
+}
+
+// LogEntry is an event read from an event log.
+type LogEntry struct {
+	Position EventCursor
+	Data     json.RawMessage
+}
+
+func (l *EventLog) segmentKey(segment int64) string {
+	return fmt.Sprintf("%s%020d", l.Prefix, segment)
+}
+
+// latestSegment returns the number of the newest segment, or -1 if the log
+// is empty.
+func (l *EventLog) latestSegment() (int64, error) {
+	listing, err := l.Store.List(&ListOptions{Prefix: l.Prefix})
+	if err != nil {
+		return 0, err
+	}
+
+	latest := int64(-1)
+	for _, blob := range listing.Blobs {
+		segment, err := strconv.ParseInt(strings.TrimPrefix(blob.Key, l.Prefix), 10, 64)
+		if err == nil && segment > latest {
+			latest = segment
+		}
+	}
+
+	return latest, nil
+}
+
+func (l *EventLog) readSegment(ctx context.Context, segment int64) ([]byte, string, error) {
+	res, err := l.Store.getIncludingExpired(ctx, l.segmentKey(segment), HTTPMethodGet, map[string]string{})
+	if err != nil || res == nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return data, res.Header.Get("etag"), nil
+}
+
+// Append adds an event to the end of the log and returns its position.
+func (l *EventLog) Append(ctx context.Context, event interface{}) (EventCursor, error) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return EventCursor{}, err
+	}
+	line = append(line, '\n')
+
+	for attempt := 0; ; attempt++ {
+		segment, err := l.latestSegment()
+		if err != nil {
+			return EventCursor{}, err
+		}
+
+		var data []byte
+		etag := ""
+		if segment >= 0 {
+			data, etag, err = l.readSegment(ctx, segment)
+			if err != nil {
+				return EventCursor{}, err
+			}
+		}
+
+		options := &SetOptions{OnlyIfMatch: etag}
+		if segment < 0 || etag == "" || int64(len(data)) >= l.segmentSize() {
+			segment++
+			data = nil
+			options = &SetOptions{OnlyIfNew: true}
+		}
+
+		cursor := EventCursor{
+			Segment: segment,
+			Offset:  bytes.Count(data, []byte{'\n'}),
+		}
+
+		err = l.Store.Set(l.segmentKey(segment), bytes.NewReader(append(data, line...)), options)
+		if err == nil {
+			return cursor, nil
+		}
+
+		var preconditionError *BlobsPreconditionError
+		if !errors.As(err, &preconditionError) || attempt+1 >= UPDATE_MAX_ATTEMPTS {
+			return EventCursor{}, err
+		}
+
+		err = sleepWithBackoff(ctx, attempt)
+		if err != nil {
+			return EventCursor{}, err
+		}
+	}
+}
+
+// Read returns up to limit events starting at cursor, along with the cursor
+// to continue from. Reading only moves past a segment once it is sealed, so
+// events appended later are never skipped.
+func (l *EventLog) Read(ctx context.Context, cursor EventCursor, limit int) ([]LogEntry, EventCursor, error) {
+	entries := []LogEntry{}
+
+	for limit <= 0 || len(entries) < limit {
+		data, etag, err := l.readSegment(ctx, cursor.Segment)
+		if err != nil {
+			return nil, cursor, err
+		}
+		if etag == "" && data == nil {
+			return entries, cursor, nil
+		}
+
+		lines := bytes.Split(data, []byte{'\n'})
+		// The data ends with a newline, so the last element is empty.
+		lines = lines[:len(lines)-1]
+
+		for cursor.Offset < len(lines) && (limit <= 0 || len(entries) < limit) {
+			entries = append(entries, LogEntry{
+				Position: cursor,
+				Data:     json.RawMessage(lines[cursor.Offset]),
+			})
+			cursor.Offset++
+		}
+
+		if cursor.Offset < len(lines) || int64(len(data)) < l.segmentSize() {
+			return entries, cursor, nil
+		}
+
+		cursor = EventCursor{Segment: cursor.Segment + 1}
+	}
+
+	return entries, cursor, nil
+}
+
+// VERSIONS_PREFIX is the hidden key prefix under which prior values are
+// kept, as .versions/<key>/<version ID>.
+const VERSIONS_PREFIX = ".versions/"
+
+// Metadata keys linking a value to its versions.
+const (
+	VERSION_OF_METADATA_KEY       = "_version_of"
+	VERSION_PREVIOUS_METADATA_KEY = "_version_previous"
+)
+
+// VersionRetention limits how many prior values are kept for each key.
+// Zero values disable the respective limit.
+type VersionRetention struct {
+	MaxVersions int
+	MaxAge      time.Duration
+}
+
+// VersionInfo describes a prior value of a key.
+type VersionInfo struct {
+	ID        string
+	Key       string
+	CreatedAt time.Time
+	Size      int64
+}
+
+// VersionedStore keeps the previous value of a key whenever it is
+// overwritten or deleted. The current value stays under its key and links
+// to the latest prior version through its metadata.
+type VersionedStore struct {
+	Store     *Store
+	Retention VersionRetention
+}
+
+// NewVersionedStore creates a versioned store on top of an existing store.
+func NewVersionedStore(store *Store, retention VersionRetention) *VersionedStore {
+	return &VersionedStore{
+		Store:     store,
+		Retention: retention,
+	}
+}
+
+func versionPrefix(key string) string {
+	return VERSIONS_PREFIX + key + "/"
+}
+
+// archive copies the current value of key to a new version and returns the
+// version ID and the ETag of the value that was archived. Both are empty
+// if the key does not exist.
+func (v *VersionedStore) archive(ctx context.Context, key string) (string, string, error) {
+	res, err := v.Store.getIncludingExpired(ctx, key, HTTPMethodGet, map[string]string{})
+	if err != nil || res == nil {
+		return "", "", err
+	}
+	defer res.Body.Close()
+
+	metadata, err := getMetadataFromResponse(res)
+	if err != nil {
+		return "", "", err
+	}
+	metadata[VERSION_OF_METADATA_KEY] = key
+
+	id := fmt.Sprintf("%020d", time.Now().UnixNano())
+	err = v.Store.Set(versionPrefix(key)+id, res.Body, &SetOptions{
+		Metadata: metadata,
+		Size:     res.ContentLength,
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	return id, res.Header.Get("etag"), nil
+}
+
+// Set stores data under key after archiving the value it replaces.
+func (v *VersionedStore) Set(key string, data io.Reader, options *SetOptions) error {
+	if options == nil {
+		options = &SetOptions{}
+	}
+
+	err := v.Store.checkKey(versionPrefix(key) + fmt.Sprintf("%020d", 0))
+	if err != nil {
+		return err
+	}
+
+	// The value is kept in memory so the write can be retried if another
+	// writer replaces the key while its previous value is being archived.
+	value, err := io.ReadAll(data)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	return v.replace(ctx, key, func(id string, etag string) error {
+		metadata := options.storedMetadata()
+		if id != "" {
+			metadata[VERSION_PREVIOUS_METADATA_KEY] = id
+		}
+
+		_, err := v.Store.set(ctx, key, bytes.NewReader(value), &SetOptions{
+			Metadata:    metadata,
+			OnlyIfMatch: etag,
+			OnlyIfNew:   id == "",
+			Progress:    options.Progress,
+		})
+		return err
+	})
+}
+
+// replace archives the current value of key and then calls write with the
+// version ID and the ETag that was archived, which write must make its
+// change conditional on. If another writer changes the key in between, the
+// whole sequence is retried, so no value is replaced without being archived
+// first. The version archived by the failed attempt is kept.
+func (v *VersionedStore) replace(ctx context.Context, key string, write func(id string, etag string) error) error {
+	for attempt := 0; ; attempt++ {
+		id, etag, err := v.archive(ctx, key)
+		if err != nil {
+			return err
+		}
+		if id != "" && etag == "" {
+			return fmt.Errorf("cannot archive key %q: the store did not report its ETag", key)
+		}
+
+		err = write(id, etag)
+
+		var preconditionError *BlobsPreconditionError
+		if errors.As(err, &preconditionError) && attempt+1 < UPDATE_MAX_ATTEMPTS {
+			err = sleepWithBackoff(ctx, attempt)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		_, err = v.Prune(ctx, key)
+		return err
+	}
+}
+
+// Get retrieves the current value of a key.
+func (v *VersionedStore) Get(key string) (io.ReadCloser, error) {
+	return v.Store.Get(key)
+}
+
+// Delete archives the current value of a key and then removes it, as long
+// as it has not changed since it was archived. Deleting a key that does not
+// exist is not an error.
+func (v *VersionedStore) Delete(key string) error {
+	ctx := context.Background()
+	return v.replace(ctx, key, func(id string, etag string) error {
+		if id == "" {
+			return nil
+		}
+		return v.Store.delete(ctx, key, etag)
+	})
+}
+
+// List lists current values, hiding the versions prefix.
+func (v *VersionedStore) List(options *ListOptions) (*ListResult, error) {
+	result, err := v.Store.List(options)
+	if err != nil {
+		return nil, err
+	}
+
+	blobs := result.Blobs[:0]
+	for _, blob := range result.Blobs {
+		if !strings.HasPrefix(blob.Key, VERSIONS_PREFIX) {
+			blobs = append(blobs, blob)
+		}
+	}
+	result.Blobs = blobs
+
+	directories := result.Directories[:0]
+	for _, directory := range result.Directories {
+		if directory+"/" != VERSIONS_PREFIX {
+			directories = append(directories, directory)
+		}
+	}
+	result.Directories = directories
+
+	return result, nil
+}
+
+// ListVersions returns the prior values of a key, newest first.
+func (v *VersionedStore) ListVersions(key string) ([]VersionInfo, error) {
+	listing, err := v.Store.List(&ListOptions{Prefix: versionPrefix(key)})
+	if err != nil {
+		return nil, err
+	}
+
+	versions := []VersionInfo{}
+	for _, blob := range listing.Blobs {
+		id := strings.TrimPrefix(blob.Key, versionPrefix(key))
+		if strings.Contains(id, "/") {
+			continue
+		}
+
+		nanos, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		versions = append(versions, VersionInfo{
+			ID:        id,
+			Key:       key,
+			CreatedAt: time.Unix(0, nanos),
+			Size:      blob.Size,
+		})
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].ID > versions[j].ID
+	})
+
+	return versions, nil
+}
+
+// GetVersion retrieves a prior value of a key. It returns nil if the
+// version does not exist.
+func (v *VersionedStore) GetVersion(key string, id string) (*GetWithMetadataResult, error) {
+	entry, err := v.Store.GetWithMetadata(versionPrefix(key) + id)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+
+	delete(entry.Metadata, VERSION_OF_METADATA_KEY)
+	return entry, nil
+}
+
+// Restore makes a prior value current again. The value it replaces is
+// archived like any other overwrite.
+func (v *VersionedStore) Restore(key string, id string) error {
+	entry, err := v.GetVersion(key, id)
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return fmt.Errorf("version %s of key %q does not exist", id, key)
+	}
+	defer entry.Data.Close()
+
+	delete(entry.Metadata, VERSION_PREVIOUS_METADATA_KEY)
+
+	return v.Set(key, entry.Data, &SetOptions{
+		Metadata: entry.Metadata,
+	})
+}
+
+// Prune removes the versions of a key that fall outside the retention
+// policy and returns how many were removed.
+func (v *VersionedStore) Prune(ctx context.Context, key string) (int, error) {
+	if v.Retention.MaxVersions <= 0 && v.Retention.MaxAge <= 0 {
+		return 0, nil
+	}
+
+	versions, err := v.ListVersions(key)
+	if err != nil {
+		return 0, err
+	}
+
+	expired := []string{}
+	for i, version := range versions {
+		if (v.Retention.MaxVersions > 0 && i >= v.Retention.MaxVersions) ||
+			(v.Retention.MaxAge > 0 && time.Since(version.CreatedAt) > v.Retention.MaxAge) {
+			expired = append(expired, versionPrefix(key)+version.ID)
+		}
+	}
+
+	results, err := v.Store.DeleteMany(ctx, expired, nil)
+	if err != nil {
+		return 0, err
+	}
+	for _, result := range results {
+		if result.Err != nil {
+			return 0, fmt.Errorf("deleting version %q: %w", result.Key, result.Err)
+		}
+	}
+
+	return len(expired), nil
+}
+
+// TRASH_PREFIX is the hidden key prefix under which soft-deleted blobs are
+// kept, as .trash/<key>/<deletion ID>.
+const TRASH_PREFIX = ".trash/"
+
+// DELETED_AT_METADATA_KEY records when a blob was soft-deleted, in Unix
+// milliseconds.
+const DELETED_AT_METADATA_KEY = "_deleted_at"
+
+// TrashEntry describes a soft-deleted blob.
+type TrashEntry struct {
+	ID        string
+	Key       string
+	DeletedAt time.Time
+	Size      int64
+}
+
+func trashKey(key string, id string) string {
+	return TRASH_PREFIX + key + "/" + id
+}
+
+// SoftDelete moves a key into the trash along with its metadata, from where
+// it can be brought back with Undelete. Deleting a key that does not exist
+// is not an error. If the key is written while it is being moved, the new
+// value is kept and a BlobsPreconditionError is returned.
+func (s *Store) SoftDelete(key string) error {
+	now := time.Now()
+	id := fmt.Sprintf("%020d", now.UnixNano())
+
+	err := s.checkKey(trashKey(key, id))
+	if err != nil {
+		return err
+	}
+
+	res, err := s.get(context.Background(), key, HTTPMethodGet, map[string]string{})
+	if err != nil {
+		return err
+	}
+	if res == nil {
+		return s.Delete(key)
+	}
+	defer res.Body.Close()
+
+	metadata, err := getMetadataFromResponse(res)
+	if err != nil {
+		return err
+	}
+	metadata[DELETED_AT_METADATA_KEY] = now.UnixMilli()
+
+	err = s.Set(trashKey(key, id), res.Body, &SetOptions{
+		Metadata: metadata,
+		Size:     res.ContentLength,
+	})
+	if err != nil {
+		return err
+	}
+
+	// A write that landed after the read is kept, along with the copy in
+	// the trash.
+	return s.delete(context.Background(), key, res.Header.Get("etag"))
+}
+
+// ListTrash returns the soft-deleted blobs whose keys start with prefix,
+// newest first.
+func (s *Store) ListTrash(prefix string) ([]TrashEntry, error) {
+	entries := []TrashEntry{}
+
+	err := s.ListPages(&ListOptions{Prefix: TRASH_PREFIX + prefix}, func(page *ListResult) error {
+		for _, blob := range page.Blobs {
+			path := strings.TrimPrefix(blob.Key, TRASH_PREFIX)
+
+			slash := strings.LastIndex(path, "/")
+			if slash < 0 {
+				continue
+			}
+
+			nanos, err := strconv.ParseInt(path[slash+1:], 10, 64)
+			if err != nil {
+				continue
+			}
+
+			entries = append(entries, TrashEntry{
+				ID:        path[slash+1:],
+				Key:       path[:slash],
+				DeletedAt: time.Unix(0, nanos),
+				Size:      blob.Size,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ID > entries[j].ID
+	})
+
+	return entries, nil
+}
+
+// Undelete restores the most recently soft-deleted copy of a key. It fails
+// with a BlobsPreconditionError if the key has been written again since.
+func (s *Store) Undelete(key string) error {
+	entries, err := s.ListTrash(key + "/")
+	if err != nil {
+		return err
+	}
+
+	var latest *TrashEntry
+	for i := range entries {
+		if entries[i].Key == key {
+			latest = &entries[i]
+			break
+		}
+	}
+	if latest == nil {
+		return fmt.Errorf("key %q is not in the trash", key)
+	}
+
+	entry, err := s.GetWithMetadata(trashKey(key, latest.ID))
+	if err != nil {
+		return err
+	}
+	if entry == nil {
+		return fmt.Errorf("key %q is not in the trash", key)
+	}
+	defer entry.Data.Close()
+
+	delete(entry.Metadata, DELETED_AT_METADATA_KEY)
+
+	err = s.Set(key, entry.Data, &SetOptions{
+		Metadata:  entry.Metadata,
+		OnlyIfNew: true,
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.Delete(trashKey(key, latest.ID))
+}
+
+// PurgeTrash permanently removes soft-deleted blobs that have been in the
+// trash for longer than retention and returns how many were removed.
+func (s *Store) PurgeTrash(ctx context.Context, retention time.Duration) (int, error) {
+	entries, err := s.ListTrash("")
+	if err != nil {
+		return 0, err
+	}
+
+	expired := []string{}
+	for _, entry := range entries {
+		if time.Since(entry.DeletedAt) > retention {
+			expired = append(expired, trashKey(entry.Key, entry.ID))
+		}
+	}
+
+	results, err := s.DeleteMany(ctx, expired, nil)
+	if err != nil {
+		return 0, err
+	}
+	for _, result := range results {
+		if result.Err != nil {
+			return 0, fmt.Errorf("purging key %q: %w", result.Key, result.Err)
+		}
+	}
+
+	return len(expired), nil
+}
+
+// INDEX_PREFIX is the hidden key prefix under which the metadata index is
+// kept, as one empty blob per .index/<field>/<value>/<key>.
+const INDEX_PREFIX = ".index/"
+
+// indexSegmentEscaper escapes the characters that would otherwise break an
+// index key into the wrong segments. Each character is escaped on its own,
+// so the escaped form of a prefix is a prefix of the escaped value.
+var indexSegmentEscaper = strings.NewReplacer("~", "~7E", "/", "~2F", "%", "~25")
+
+var indexSegmentUnescaper = strings.NewReplacer("~2F", "/", "~25", "%", "~7E", "~")
+
+// indexValue returns the string form of a metadata value as indexed.
+func indexValue(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(encoded)
+}
+
+func indexFieldPrefix(field string) string {
+	return INDEX_PREFIX + indexSegmentEscaper.Replace(field) + "/"
+}
+
+func indexEntryKey(field string, value string, key string) string {
+	return indexFieldPrefix(field) + indexSegmentEscaper.Replace(value) + "/" + indexSegmentEscaper.Replace(key)
+}
+
+// isHiddenCopy reports whether a key holds an internal copy of another
+// blob, which carries that blob's metadata but must not be indexed.
+func isHiddenCopy(key string) bool {
+	for _, prefix := range []string{CHUNKS_PREFIX, CONTENT_PREFIX, TRASH_PREFIX, VERSIONS_PREFIX} {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// IndexQuery selects blobs by the value of an indexed metadata field.
+type IndexQuery struct {
+	Field string
+	Value string
+	// Prefix matches every value starting with Value rather than only
+	// Value itself.
+	Prefix bool
+}
+
+// IndexRebuildResult represents the outcome of an index rebuild.
+type IndexRebuildResult struct {
+	Scanned int
+	Added   int
+	Removed int
+}
+
+// IndexedStore maintains an inverted index of selected metadata fields so
+// blobs can be found by attribute without inspecting every key. Entries for
+// a new value are written before the blob and stale entries are removed
+// after it, so a single writer never leaves a key unindexed. The index is
+// best-effort: the steps are not atomic, and concurrent writes to the same
+// key can leave stale entries or remove the entry of the value that wins.
+// Rebuild, or the index-rebuild command, repairs it.
+type IndexedStore struct {
+	Store  *Store
+	Fields []string
+}
+
+// NewIndexedStore creates an indexed store on top of an existing store.
+func NewIndexedStore(store *Store, fields ...string) *IndexedStore {
+	return &IndexedStore{
+		Store:  store,
+		Fields: fields,
+	}
+}
+
+// entries returns the index keys for a blob with the given metadata.
+func (i *IndexedStore) entries(key string, metadata Metadata) map[string]bool {
+	entries := map[string]bool{}
+	for _, field := range i.Fields {
+		if value, ok := metadata[field]; ok && value != nil {
+			entries[indexEntryKey(field, indexValue(value), key)] = true
+		}
+	}
+	return entries
+}
+
+func (i *IndexedStore) currentEntries(key string) (map[string]bool, error) {
+	current, err := i.Store.GetMetadata(key)
+	if err != nil {
+		return nil, err
+	}
+	if current == nil {
+		return map[string]bool{}, nil
+	}
+	return i.entries(key, current.Metadata), nil
+}
+
+// addEntries writes the index keys in entries that are not in existing.
+func (i *IndexedStore) addEntries(ctx context.Context, entries map[string]bool, existing map[string]bool) (int, error) {
+	items := []BatchSetItem{}
+	for entry := range entries {
+		if !existing[entry] {
+			items = append(items, BatchSetItem{Key: entry, Data: []byte{}})
+		}
+	}
+
+	for _, result := range i.Store.SetMany(ctx, items, nil) {
+		if result.Err != nil {
+			return 0, fmt.Errorf("writing index entry %q: %w", result.Key, result.Err)
+		}
+	}
+
+	return len(items), nil
+}
+
+// removeEntries deletes the index keys in entries that are not in keep.
+func (i *IndexedStore) removeEntries(ctx context.Context, entries map[string]bool, keep map[string]bool) (int, error) {
+	keys := []string{}
+	for entry := range entries {
+		if !keep[entry] {
+			keys = append(keys, entry)
+		}
+	}
+
+	results, err := i.Store.DeleteMany(ctx, keys, nil)
+	if err != nil {
+		return 0, err
+	}
+	for _, result := range results {
+		if result.Err != nil {
+			return 0, fmt.Errorf("removing index entry %q: %w", result.Key, result.Err)
+		}
+	}
+
+	return len(keys), nil
+}
+
+// Set stores data under key and updates the index for its metadata. See
+// IndexedStore for what concurrent writes to the same key can do to the
+// index.
+func (i *IndexedStore) Set(key string, data io.Reader, options *SetOptions) error {
+	if options == nil {
+		options = &SetOptions{}
+	}
+
+	entries := i.entries(key, options.Metadata)
+	for entry := range entries {
+		err := i.Store.checkKey(entry)
+		if err != nil {
+			return fmt.Errorf("indexing key %q: %w", key, err)
+		}
+	}
+
+	ctx := context.Background()
+	previous, err := i.currentEntries(key)
+	if err != nil {
+		return err
+	}
+
+	_, err = i.addEntries(ctx, entries, previous)
+	if err != nil {
+		return err
+	}
+
+	err = i.Store.Set(key, data, options)
+	if err != nil {
+		return err
+	}
+
+	_, err = i.removeEntries(ctx, previous, entries)
+	return err
+}
+
+// Get retrieves the value of a key.
+func (i *IndexedStore) Get(key string) (io.ReadCloser, error) {
+	return i.Store.Get(key)
+}
+
+// Delete removes a key and its index entries.
+func (i *IndexedStore) Delete(key string) error {
+	previous, err := i.currentEntries(key)
+	if err != nil {
+		return err
+	}
+
+	err = i.Store.Delete(key)
+	if err != nil {
+		return err
+	}
+
+	_, err = i.removeEntries(context.Background(), previous, nil)
+	return err
+}
+
+// List lists blobs, hiding the index prefix.
+func (i *IndexedStore) List(options *ListOptions) (*ListResult, error) {
+	result, err := i.Store.List(options)
+	if err != nil {
+		return nil, err
+	}
+
+	blobs := result.Blobs[:0]
+	for _, blob := range result.Blobs {
+		if !strings.HasPrefix(blob.Key, INDEX_PREFIX) {
+			blobs = append(blobs, blob)
+		}
+	}
+	result.Blobs = blobs
+
+	directories := result.Directories[:0]
+	for _, directory := range result.Directories {
+		if directory+"/" != INDEX_PREFIX {
+			directories = append(directories, directory)
+		}
+	}
+	result.Directories = directories
+
+	return result, nil
+}
+
+// Query returns the sorted keys whose indexed field matches the query.
+func (i *IndexedStore) Query(query IndexQuery) ([]string, error) {
+	indexed := false
+	for _, field := range i.Fields {
+		indexed = indexed || field == query.Field
+	}
+	if !indexed {
+		return nil, fmt.Errorf("metadata field %q is not indexed", query.Field)
+	}
+
+	prefix := indexFieldPrefix(query.Field) + indexSegmentEscaper.Replace(query.Value)
+	if !query.Prefix {
+		prefix += "/"
+	}
+
+	seen := map[string]bool{}
+	keys := []string{}
+
+	err := i.Store.ListPages(&ListOptions{Prefix: prefix}, func(page *ListResult) error {
+		for _, blob := range page.Blobs {
+			segments := strings.Split(strings.TrimPrefix(blob.Key, indexFieldPrefix(query.Field)), "/")
+			if len(segments) != 2 {
+				continue
+			}
+
+			key := indexSegmentUnescaper.Replace(segments[1])
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Rebuild brings the index in line with the metadata of every blob in the
+// store, adding missing entries and removing stale ones, including entries
+// for fields that are no longer indexed.
+func (i *IndexedStore) Rebuild(ctx context.Context, options *BatchOptions) (*IndexRebuildResult, error) {
+	result := &IndexRebuildResult{}
+	existing := map[string]bool{}
+	keys := []string{}
+
+	err := i.Store.ListPages(&ListOptions{}, func(page *ListResult) error {
+		for _, blob := range page.Blobs {
+			switch {
+			case strings.HasPrefix(blob.Key, INDEX_PREFIX):
+				existing[blob.Key] = true
+			case isHiddenCopy(blob.Key):
+			default:
+				keys = append(keys, blob.Key)
+			}
+		}
+		return ctx.Err()
+	})
+	if err != nil {
+		return result, err
+	}
+
+	found := make([]map[string]bool, len(keys))
+	errs := runBatch(ctx, len(keys), options.concurrency(), func(ctx context.Context, n int) error {
+		entries, err := i.currentEntries(keys[n])
+		found[n] = entries
+		return err
+	})
+
+	desired := map[string]bool{}
+	for n, key := range keys {
+		if errs[n] != nil {
+			return result, fmt.Errorf("inspecting key %q: %w", key, errs[n])
+		}
+		result.Scanned++
+		for entry := range found[n] {
+			if i.Store.checkKey(entry) == nil {
+				desired[entry] = true
+			}
+		}
+	}
+
+	result.Added, err = i.addEntries(ctx, desired, existing)
+	if err != nil {
+		return result, err
+	}
+
+	result.Removed, err = i.removeEntries(ctx, existing, desired)
+	return result, err
+}
+
+// Key prefixes for tenant data and for the usage counters kept per tenant.
+const (
+	TENANTS_PREFIX      = "tenants/"
+	TENANT_USAGE_PREFIX = ".tenant-usage/"
+)
+
+// TenantQuota limits what a tenant may store. Zero values disable the
+// respective limit.
+type TenantQuota struct {
+	MaxBytes   int64
+	MaxObjects int64
+}
+
+// TenantUsage is what a tenant currently stores.
+type TenantUsage struct {
+	Bytes   int64 `json:"bytes"`
+	Objects int64 `json:"objects"`
+}
+
+// QuotaExceededError is returned when a write would take a tenant over its
+// quota.
+type QuotaExceededError struct {
+	Tenant  string
+	Usage   TenantUsage
+	Quota   TenantQuota
+	Message string
+}
+
+func (e *QuotaExceededError) Error() string {
+	return e.Message
+}
+
+func NewQuotaExceededError(tenant string, usage TenantUsage, quota TenantQuota) *QuotaExceededError {
+	return &QuotaExceededError{
+		Tenant: tenant,
+		Usage:  usage,
+		Quota:  quota,
+		Message: fmt.Sprintf(
+			"tenant %q would store %d bytes in %d objects, exceeding its quota of %d bytes in %d objects",
+			tenant, usage.Bytes, usage.Objects, quota.MaxBytes, quota.MaxObjects,
+		),
+	}
+}
+
+// TenantedStore hosts several tenants in one store. Each tenant sees only
+// the keys under its own prefix, and its usage is tracked against a quota.
+type TenantedStore struct {
+	Store *Store
+	// Quota applies to every tenant without an entry in Quotas.
+	Quota  TenantQuota
+	Quotas map[string]TenantQuota
+}
+
+// NewTenantedStore creates a tenant-aware layer on top of an existing store.
+func NewTenantedStore(store *Store, quota TenantQuota) *TenantedStore {
+	return &TenantedStore{
+		Store: store,
+		Quota: quota,
+	}
+}
+
+func validateTenantID(id string) error {
+	if id == "" || id == "." || id == ".." || strings.Contains(id, "/") {
+		return fmt.Errorf("invalid tenant ID %q", id)
+	}
+	return nil
+}
+
+// validateTenantKey rejects dot segments, which would otherwise be resolved
+// in the request URL and let a key reach outside the tenant's prefix.
+func validateTenantKey(key string) error {
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "." || segment == ".." {
+			return fmt.Errorf("key %q must not contain . or .. segments", key)
+		}
+	}
+	return nil
+}
+
+// Tenant returns the view of the store that belongs to a tenant.
+func (t *TenantedStore) Tenant(id string) (*TenantStore, error) {
+	err := validateTenantID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	quota, ok := t.Quotas[id]
+	if !ok {
+		quota = t.Quota
+	}
+
+	return &TenantStore{
+		ID:    id,
+		Quota: quota,
+		store: t.Store.Sub(TENANTS_PREFIX + id + "/"),
+		usage: t.Store,
+	}, nil
+}
+
+// TenantStore is one tenant's view of a TenantedStore. Usage counters are
+// reserved before each write, so concurrent writers cannot overshoot the
+// quota together, and released again if the write fails.
+type TenantStore struct {
+	ID    string
+	Quota TenantQuota
+
+	store *Store
+	usage *Store
+}
+
+func (t *TenantStore) usageKey() string {
+	return TENANT_USAGE_PREFIX + t.ID
+}
+
+// Usage returns what the tenant currently stores.
+func (t *TenantStore) Usage() (*TenantUsage, error) {
+	usage := &TenantUsage{}
+
+	data, _, _, err := t.usage.readForUpdate(context.Background(), t.usageKey())
+	if err != nil || len(data) == 0 {
+		return usage, err
+	}
+
+	err = json.Unmarshal(data, usage)
+	if err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// adjust adds delta to the tenant's usage, failing with a
+// QuotaExceededError if enforce is set and the result is over quota.
+func (t *TenantStore) adjust(ctx context.Context, delta TenantUsage, enforce bool) error {
+	_, err := t.usage.Update(ctx, t.usageKey(), func(old []byte) ([]byte, error) {
+		usage := TenantUsage{}
+		if len(old) > 0 {
+			err := json.Unmarshal(old, &usage)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		usage.Bytes += delta.Bytes
+		usage.Objects += delta.Objects
+
+		if enforce &&
+			((t.Quota.MaxBytes > 0 && delta.Bytes > 0 && usage.Bytes > t.Quota.MaxBytes) ||
+				(t.Quota.MaxObjects > 0 && delta.Objects > 0 && usage.Objects > t.Quota.MaxObjects)) {
+			return nil, NewQuotaExceededError(t.ID, usage, t.Quota)
+		}
+
+		return json.Marshal(usage)
+	})
+	return err
+}
+
+// storedSize returns the size of a key as counted in the tenant's usage,
+// or -1 if it does not exist. Expired blobs still count until removed.
+func (t *TenantStore) storedSize(ctx context.Context, key string) (int64, error) {
+	res, err := t.store.getIncludingExpired(ctx, key, HTTPMethodHead, map[string]string{})
+	if err != nil || res == nil {
+		return -1, err
+	}
+	res.Body.Close()
+
+	if res.ContentLength < 0 {
+		return 0, nil
+	}
+	return res.ContentLength, nil
+}
+
+// Set stores data under one of the tenant's keys, failing with a
+// QuotaExceededError if it would take the tenant over its quota.
+func (t *TenantStore) Set(key string, data io.Reader, options *SetOptions) error {
+	if options == nil {
+		options = &SetOptions{}
+	}
+
+	err := validateTenantKey(key)
+	if err != nil {
+		return err
+	}
+	err = t.store.checkKey(key)
+	if err != nil {
+		return err
+	}
+
+	var input BlobInput = data
+	size := options.Size
+	if size <= 0 {
+		size = contentLength(input)
+	}
+	if size < 0 {
+		buffered, err := io.ReadAll(data)
+		if err != nil {
+			return err
+		}
+		input = bytes.NewReader(buffered)
+		size = int64(len(buffered))
+	}
+
+	ctx := context.Background()
+	previous, err := t.storedSize(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	delta := TenantUsage{Bytes: size, Objects: 1}
+	if previous >= 0 {
+		delta = TenantUsage{Bytes: size - previous}
+	}
+
+	err = t.adjust(ctx, delta, true)
+	if err != nil {
+		return err
+	}
+
+	stored := *options
+	stored.Size = size
+	err = t.store.Set(key, input, &stored)
+	if err != nil {
+		t.adjust(ctx, TenantUsage{Bytes: -delta.Bytes, Objects: -delta.Objects}, false)
+		return err
+	}
+
+	return nil
+}
+
+// Get retrieves one of the tenant's keys.
+func (t *TenantStore) Get(key string) (io.ReadCloser, error) {
+	err := validateTenantKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return t.store.Get(key)
+}
+
+// GetWithMetadata retrieves one of the tenant's keys with its metadata.
+func (t *TenantStore) GetWithMetadata(key string) (*GetWithMetadataResult, error) {
+	err := validateTenantKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return t.store.GetWithMetadata(key)
+}
+
+// Delete removes one of the tenant's keys and releases its usage.
+func (t *TenantStore) Delete(key string) error {
+	err := validateTenantKey(key)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	previous, err := t.storedSize(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	err = t.store.Delete(key)
+	if err != nil || previous < 0 {
+		return err
+	}
+
+	return t.adjust(ctx, TenantUsage{Bytes: -previous, Objects: -1}, false)
+}
+
+// List lists the tenant's keys, relative to its prefix.
+func (t *TenantStore) List(options *ListOptions) (*ListResult, error) {
+	return t.store.List(options)
+}
+
+// Recount recomputes the tenant's usage from a listing of its keys, fixing
+// counters left behind by interrupted writes.
+func (t *TenantStore) Recount(ctx context.Context) (*TenantUsage, error) {
+	usage := TenantUsage{}
+
+	err := t.store.ListPages(nil, func(page *ListResult) error {
+		for _, blob := range page.Blobs {
+			usage.Bytes += blob.Size
+			usage.Objects++
+		}
+		return ctx.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = t.usage.Update(ctx, t.usageKey(), func(old []byte) ([]byte, error) {
+		return json.Marshal(usage)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &usage, nil
+}
+
+// STATS_HISTOGRAM_BOUNDS are the upper size bounds of the histogram buckets
+// in a StoreStats report. Larger blobs fall into a final, unbounded bucket.
+var STATS_HISTOGRAM_BOUNDS = []int64{1 << 10, 16 << 10, 256 << 10, 4 << 20, 64 << 20, 1 << 30}
+
+// StatsOptions represents options for Store.Stats.
+type StatsOptions struct {
+	// Prefix limits the report to keys that start with it.
+	Prefix string
+	// TopKeys is the number of largest keys reported. Defaults to 10.
+	TopKeys int
+	// PrefixDepth is the number of key segments the per-prefix breakdown
+	// groups by. Defaults to 1.
+	PrefixDepth int
+}
+
+// SizeBucket counts the blobs whose size is at least Min and at most Max.
+// A Max of -1 means the bucket is unbounded.
+type SizeBucket struct {
+	Min     int64 `json:"min"`
+	Max     int64 `json:"max"`
+	Objects int64 `json:"objects"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// PrefixStats is the usage of the keys under one prefix.
+type PrefixStats struct {
+	Prefix  string `json:"prefix"`
+	Objects int64  `json:"objects"`
+	Bytes   int64  `json:"bytes"`
+}
+
+// StoreStats is a report of how much a store holds.
+type StoreStats struct {
+	Objects   int64            `json:"objects"`
+	Bytes     int64            `json:"bytes"`
+	Histogram []SizeBucket     `json:"histogram"`
+	Largest   []ListResultBlob `json:"largest"`
+	Prefixes  []PrefixStats    `json:"prefixes"`
+}
+
+// statsPrefix returns the first depth segments of key, or an empty string
+// for keys with fewer segments.
+func statsPrefix(key string, depth int) string {
+	end := 0
+	for i := 0; i < depth; i++ {
+		slash := strings.Index(key[end:], "/")
+		if slash < 0 {
+			return ""
+		}
+		end += slash + 1
+	}
+	return key[:end]
+}
+
+// Stats walks the listing and reports the number and size of the blobs in
+// the store. Sizes are those reported by the listing, so it costs one
+// request per page.
+func (s *Store) Stats(ctx context.Context, options *StatsOptions) (*StoreStats, error) {
+	if options == nil {
+		options = &StatsOptions{}
+	}
+
+	topKeys := options.TopKeys
+	if topKeys <= 0 {
+		topKeys = 10
+	}
+
+	depth := options.PrefixDepth
+	if depth <= 0 {
+		depth = 1
+	}
+
+	stats := &StoreStats{
+		Histogram: make([]SizeBucket, len(STATS_HISTOGRAM_BOUNDS)+1),
+		Largest:   []ListResultBlob{},
+		Prefixes:  []PrefixStats{},
+	}
+
+	min := int64(0)
+	for i, bound := range STATS_HISTOGRAM_BOUNDS {
+		stats.Histogram[i] = SizeBucket{Min: min, Max: bound}
+		min = bound + 1
+	}
+	stats.Histogram[len(STATS_HISTOGRAM_BOUNDS)] = SizeBucket{Min: min, Max: -1}
+
+	largestFirst := func() {
+		sort.SliceStable(stats.Largest, func(i, j int) bool {
+			return stats.Largest[i].Size > stats.Largest[j].Size
+		})
+	}
+
+	prefixes := map[string]*PrefixStats{}
+
+	err := s.ListPages(&ListOptions{Prefix: options.Prefix}, func(page *ListResult) error {
+		for _, blob := range page.Blobs {
+			stats.Objects++
+			stats.Bytes += blob.Size
+
+			bucket := sort.Search(len(STATS_HISTOGRAM_BOUNDS), func(i int) bool {
+				return blob.Size <= STATS_HISTOGRAM_BOUNDS[i]
+			})
+			stats.Histogram[bucket].Objects++
+			stats.Histogram[bucket].Bytes += blob.Size
+
+			prefix := statsPrefix(blob.Key, depth)
+			if prefixes[prefix] == nil {
+				prefixes[prefix] = &PrefixStats{Prefix: prefix}
+			}
+			prefixes[prefix].Objects++
+			prefixes[prefix].Bytes += blob.Size
+
+			// Candidates are trimmed only once twice as many have built up,
+			// which keeps the sorting cost per blob low.
+			stats.Largest = append(stats.Largest, blob)
+			if len(stats.Largest) >= 2*topKeys {
+				largestFirst()
+				stats.Largest = stats.Largest[:topKeys]
+			}
+		}
+		return ctx.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	largestFirst()
+	if len(stats.Largest) > topKeys {
+		stats.Largest = stats.Largest[:topKeys]
+	}
+
+	for _, prefix := range prefixes {
+		stats.Prefixes = append(stats.Prefixes, *prefix)
+	}
+	sort.Slice(stats.Prefixes, func(i, j int) bool {
+		if stats.Prefixes[i].Bytes != stats.Prefixes[j].Bytes {
+			return stats.Prefixes[i].Bytes > stats.Prefixes[j].Bytes
+		}
+		return stats.Prefixes[i].Prefix < stats.Prefixes[j].Prefix
+	})
+
+	return stats, nil
+}
+
+// formatBytes formats a size with a binary unit, such as "1.5 MiB".
+func formatBytes(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	value := float64(n)
+	for _, unit := range []string{"KiB", "MiB", "GiB", "TiB"} {
+		value /= 1024
+		if value < 1024 || unit == "TiB" {
+			return fmt.Sprintf("%.1f %s", value, unit)
+		}
+	}
+	return ""
+}
+
+// AUDIT_STORE_NAME is the store the handler writes its audit log to.
+const AUDIT_STORE_NAME = "audit-log"
+
+// BlobAuditSink collects audit events and writes them to a store in
+// segments of newline-delimited JSON, keyed by day and time so they list in
+// order. Use its Record method as a Client's Audit hook and call Flush
+// before the invocation ends.
+type BlobAuditSink struct {
+	// BatchSize is the number of events written per segment. Defaults to
+	// 100.
+	BatchSize int
+
+	store   *Store
+	mu      sync.Mutex
+	pending []AuditEvent
+}
+
+// NewBlobAuditSink creates a sink that writes segments to store. The
+// segments themselves are written without auditing, even if the store's
+// client is the one being audited.
+func NewBlobAuditSink(store *Store) *BlobAuditSink {
+	client := *store.Client
+	client.Audit = nil
+
+	sink := *store
+	sink.Client = &client
+
+	return &BlobAuditSink{
+		store: &sink,
+	}
+}
+
+func (a *BlobAuditSink) batchSize() int {
+	if a.BatchSize <= 0 {
+		return 100
+	}
+	return a.BatchSize
+}
+
+// Record queues an event and writes a segment once a batch is full. Events
+// from a segment that could not be written stay queued for the next Flush.
+func (a *BlobAuditSink) Record(event AuditEvent) {
+	a.mu.Lock()
+	a.pending = append(a.pending, event)
+	full := len(a.pending) >= a.batchSize()
+	a.mu.Unlock()
+
+	if full {
+		a.Flush(context.Background())
+	}
+}
+
+// Flush writes every queued event.
+func (a *BlobAuditSink) Flush(ctx context.Context) error {
+	for {
+		a.mu.Lock()
+		n := len(a.pending)
+		if n > a.batchSize() {
+			n = a.batchSize()
+		}
+		batch := a.pending[:n:n]
+		a.pending = a.pending[n:]
+		a.mu.Unlock()
+
+		if len(batch) == 0 {
+			return nil
+		}
+
+		err := a.writeSegment(ctx, batch)
+		if err != nil {
+			a.mu.Lock()
+			a.pending = append(batch, a.pending...)
+			a.mu.Unlock()
+			return err
+		}
+	}
+}
+
+func (a *BlobAuditSink) writeSegment(ctx context.Context, events []AuditEvent) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, event := range events {
+		err := encoder.Encode(event)
+		if err != nil {
+			return err
+		}
+	}
+
+	id, err := newUploadID()
+	if err != nil {
+		return err
+	}
+
+	key := fmt.Sprintf("%s/%s.jsonl", events[0].Time.UTC().Format("2006-01-02"), id)
+	return a.store.Set(key, &buf, &SetOptions{OnlyIfNew: true})
+}
+
+// PolicyOperation is a kind of store operation a policy rule applies to.
+type PolicyOperation string
+
+const (
+	PolicyOperationAll    PolicyOperation = "*"
+	PolicyOperationDelete PolicyOperation = "delete"
+	PolicyOperationList   PolicyOperation = "list"
+	PolicyOperationRead   PolicyOperation = "read"
+	PolicyOperationWrite  PolicyOperation = "write"
+)
+
+// Effects a policy rule can have.
+const (
+	POLICY_EFFECT_ALLOW = "allow"
+	POLICY_EFFECT_DENY  = "deny"
+)
+
+// PolicyRule allows or denies operations on the keys matching any of its
+// globs. In globs, * matches within a key segment, ** matches across
+// segments and ? matches a single character other than a slash.
+type PolicyRule struct {
+	Effect     string            `json:"effect"`
+	Operations []PolicyOperation `json:"operations"`
+	Keys       []string          `json:"keys"`
+}
+
+// Policy is a set of rules evaluated with deny-overrides: an operation is
+// allowed if any allow rule matches it and no deny rule does, whatever the
+// order of the rules.
+type Policy struct {
+	Rules []PolicyRule `json:"rules"`
+}
+
+// PolicyDeniedError is returned when a policy does not allow an operation.
+type PolicyDeniedError struct {
+	Operation PolicyOperation
+	Key       string
+	Message   string
+}
+
+func (e *PolicyDeniedError) Error() string {
+	return e.Message
+}
+
+func NewPolicyDeniedError(operation PolicyOperation, key string) *PolicyDeniedError {
+	return &PolicyDeniedError{
+		Operation: operation,
+		Key:       key,
+		Message:   fmt.Sprintf("policy denies %s on key %q", operation, key),
+	}
+}
+
+// ParsePolicy reads a policy from a JSON document such as
+//
+//	{"rules": [{"effect": "allow", "operations": ["read"], "keys": ["config/**"]}]}
+func ParsePolicy(data []byte) (*Policy, error) {
+	var policy Policy
+	err := json.Unmarshal(data, &policy)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, rule := range policy.Rules {
+		if rule.Effect != POLICY_EFFECT_ALLOW && rule.Effect != POLICY_EFFECT_DENY {
+			return nil, fmt.Errorf("policy rule %d has unknown effect %q", i, rule.Effect)
+		}
+
+		for _, operation := range rule.Operations {
+			switch operation {
+			case PolicyOperationAll, PolicyOperationDelete, PolicyOperationList, PolicyOperationRead, PolicyOperationWrite:
+			default:
+				return nil, fmt.Errorf("policy rule %d has unknown operation %q", i, operation)
+			}
+		}
+	}
+
+	return &policy, nil
+}
+
+// matchGlob reports whether key matches a policy glob.
+func matchGlob(glob string, key string) bool {
+	for len(glob) > 0 {
+		switch {
+		case strings.HasPrefix(glob, "**"):
+			rest := strings.TrimLeft(glob, "*")
+			for i := len(key); i >= 0; i-- {
+				if matchGlob(rest, key[i:]) {
+					return true
+				}
+			}
+			return false
+		case glob[0] == '*':
+			for i := 0; i <= len(key); i++ {
+				if matchGlob(glob[1:], key[i:]) {
+					return true
+				}
+				if i < len(key) && key[i] == '/' {
+					break
+				}
+			}
+			return false
+		case glob[0] == '?':
+			_, size := utf8.DecodeRuneInString(key)
+			if size == 0 || key[0] == '/' {
+				return false
+			}
+			glob, key = glob[1:], key[size:]
+		default:
+			if len(key) == 0 || glob[0] != key[0] {
+				return false
+			}
+			glob, key = glob[1:], key[1:]
+		}
+	}
+	return len(key) == 0
+}
+
+func (r *PolicyRule) matches(operation PolicyOperation, key string) bool {
+	applies := false
+	for _, candidate := range r.Operations {
+		applies = applies || candidate == operation || candidate == PolicyOperationAll
+	}
+	if !applies {
+		return false
+	}
+
+	for _, glob := range r.Keys {
+		if matchGlob(glob, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows reports whether the policy allows an operation on a key.
+func (p *Policy) Allows(operation PolicyOperation, key string) bool {
+	allowed := false
+	for i := range p.Rules {
+		if !p.Rules[i].matches(operation, key) {
+			continue
+		}
+		if p.Rules[i].Effect == POLICY_EFFECT_DENY {
+			return false
+		}
+		allowed = true
+	}
+	return allowed
+}
+
+// PolicyStore restricts a store to what a policy allows. The underlying
+// store is not reachable through it, so it can be handed to untrusted code.
+type PolicyStore struct {
+	store  *Store
+	policy *Policy
+}
+
+// NewPolicyStore wraps a store with a policy.
+func NewPolicyStore(store *Store, policy *Policy) *PolicyStore {
+	return &PolicyStore{
+		store:  store,
+		policy: policy,
+	}
+}
+
+func (p *PolicyStore) check(operation PolicyOperation, key string) error {
+	if !p.policy.Allows(operation, key) {
+		return NewPolicyDeniedError(operation, key)
+	}
+	return nil
+}
+
+// Get retrieves a value if the policy allows reading it.
+func (p *PolicyStore) Get(key string) (io.ReadCloser, error) {
+	err := p.check(PolicyOperationRead, key)
+	if err != nil {
+		return nil, err
+	}
+	return p.store.Get(key)
+}
+
+// GetWithMetadata retrieves a value and its metadata if the policy allows
+// reading it.
+func (p *PolicyStore) GetWithMetadata(key string) (*GetWithMetadataResult, error) {
+	err := p.check(PolicyOperationRead, key)
+	if err != nil {
+		return nil, err
+	}
+	return p.store.GetWithMetadata(key)
+}
+
+// GetMetadata retrieves the metadata of a key if the policy allows reading
+// it.
+func (p *PolicyStore) GetMetadata(key string) (*GetMetadataResult, error) {
+	err := p.check(PolicyOperationRead, key)
+	if err != nil {
+		return nil, err
+	}
+	return p.store.GetMetadata(key)
+}
+
+// Set stores data if the policy allows writing the key.
+func (p *PolicyStore) Set(key string, data BlobInput, options *SetOptions) error {
+	err := p.check(PolicyOperationWrite, key)
+	if err != nil {
+		return err
+	}
+	return p.store.Set(key, data, options)
+}
+
+// SetJSON stores JSON data if the policy allows writing the key.
+func (p *PolicyStore) SetJSON(key string, data interface{}, options *SetOptions) error {
+	err := p.check(PolicyOperationWrite, key)
+	if err != nil {
+		return err
+	}
+	return p.store.SetJSON(key, data, options)
+}
+
+// Delete removes a key if the policy allows deleting it.
+func (p *PolicyStore) Delete(key string) error {
+	err := p.check(PolicyOperationDelete, key)
+	if err != nil {
+		return err
+	}
+	return p.store.Delete(key)
+}
+
+// List lists the keys the policy allows listing. Directories are kept if
+// the policy allows listing the directory itself, as "<directory>/".
+func (p *PolicyStore) List(options *ListOptions) (*ListResult, error) {
+	result, err := p.store.List(options)
+	if err != nil {
+		return nil, err
+	}
+
+	blobs := result.Blobs[:0]
+	for _, blob := range result.Blobs {
+		if p.policy.Allows(PolicyOperationList, blob.Key) {
+			blobs = append(blobs, blob)
+		}
+	}
+	result.Blobs = blobs
+
+	directories := result.Directories[:0]
+	for _, directory := range result.Directories {
+		if p.policy.Allows(PolicyOperationList, directory+"/") {
+			directories = append(directories, directory)
+		}
+	}
+	result.Directories = directories
+
+	return result, nil
+}
+
+// ///////////////////////////////////////////////////////////////////////////
+type EnvironmentContext struct {
+	Edge_URL          string `json:"url,omitempty"`
+	Primary_Region    string `json:"primary_region,omitempty"`
+	Token             string `json:"token,omitempty"`
+	Uncached_Edge_URL string `json:"url_uncached,omitempty"`
+}
+
+type InvocationMetadata struct {
+	AccountTier      string `json:"accountTier,omitempty"`
+	BuildbotVersion  string `json:"buildbotVersion,omitempty"`
+	BuildVersion     string `json:"buildVersion,omitempty"`
+	Branch           string `json:"branch,omitempty"`
+	Framework        string `json:"framework,omitempty"`
+	FrameworkVersion string `json:"frameworkVersion,omitempty"`
+	FunctionName     string `json:"function_name,omitempty"`
+	Generator        string `json:"generator,omitempty"`
+}
+
+// APIGatewayRequestIdentity contains identity information for the request caller.
+type APIGatewayRequestIdentity struct {
+	CognitoIdentityPoolID         string `json:"cognitoIdentityPoolId,omitempty"`
+	AccountID                     string `json:"accountId,omitempty"`
+	CognitoIdentityID             string `json:"cognitoIdentityId,omitempty"`
+	Caller                        string `json:"caller,omitempty"`
+	APIKey                        string `json:"apiKey,omitempty"`
+	APIKeyID                      string `json:"apiKeyId,omitempty"`
+	AccessKey                     string `json:"accessKey,omitempty"`
+	SourceIP                      string `json:"sourceIp"`
+	CognitoAuthenticationType     string `json:"cognitoAuthenticationType,omitempty"`
+	CognitoAuthenticationProvider string `json:"cognitoAuthenticationProvider,omitempty"`
+	UserArn                       string `json:"userArn,omitempty"` //nolint: stylecheck
+	UserAgent                     string `json:"userAgent"`
+	User                          string `json:"user,omitempty"`
+}
+
+// APIGatewayProxyRequestContext contains the information to identify the AWS account and resources invoking the
+// Lambda function. It also includes Cognito identity information for the caller.
+type APIGatewayProxyRequestContext struct {
+	AccountID         string                    `json:"accountId"`
+	ResourceID        string                    `json:"resourceId"`
+	OperationName     string                    `json:"operationName,omitempty"`
+	Stage             string                    `json:"stage"`
+	DomainName        string                    `json:"domainName"`
+	DomainPrefix      string                    `json:"domainPrefix"`
+	RequestID         string                    `json:"requestId"`
+	ExtendedRequestID string                    `json:"extendedRequestId"`
+	Protocol          string                    `json:"protocol"`
+	Identity          APIGatewayRequestIdentity `json:"identity"`
+	ResourcePath      string                    `json:"resourcePath"`
+	Path              string                    `json:"path"`
+	Authorizer        map[string]interface{}    `json:"authorizer"`
+	HTTPMethod        string                    `json:"httpMethod"`
 	RequestTime       string                    `json:"requestTime"`
 	RequestTimeEpoch  int64                     `json:"requestTimeEpoch"`
 	APIID             string                    `json:"apiId"` // The API Gateway rest API Id
@@ -657,6 +6326,14 @@ type APIGatewayProxyRequest struct {
 	LogIngestionToken               string                 `json:"logToken,omitempty"`
 }
 
+// blobCache is shared by every invocation served by a warm function
+// instance.
+var blobCache = NewCache(CacheOptions{
+	MaxBytes:   32 << 20,
+	MaxEntries: 1024,
+	TTL:        time.Minute,
+})
+
 // func handler(ctx context.Context, request events.APIGatewayProxyRequest) (*events.APIGatewayProxyResponse, error) {
 func handler(ctx context.Context, request APIGatewayProxyRequest) (*events.APIGatewayProxyResponse, error) {
 	lc, ok := lambdacontext.FromContext(ctx)
@@ -704,14 +6381,31 @@ func handler(ctx context.Context, request APIGatewayProxyRequest) (*events.APIGa
 	region := "auto"
 	println(deploy_id, api_url, site_id, region)
 
-	store, err := NewStore("construction", Client{
+	client := Client{
 		SiteID:      site_id,
 		Token:       blobContext.Token,
 		Consistency: ConsistencyModeEventual,
-	})
+		RequestID:   request.RequestContext.RequestID,
+	}
+
+	auditStore, err := NewStore(AUDIT_STORE_NAME, client)
+	if err != nil {
+		return nil, err
+	}
+	audit := NewBlobAuditSink(auditStore)
+	client.Audit = audit.Record
+	defer func() {
+		err := audit.Flush(ctx)
+		if err != nil {
+			fmt.Printf("writing audit log: %v\n", err)
+		}
+	}()
+
+	store, err := NewStore("construction", client)
 	if err != nil {
 		return nil, err
 	}
+	store.Cache = blobCache
 	fmt.Printf("store: %+v\n", store)
 
 	someString := "hello world\nand hello go and more"
@@ -741,6 +6435,296 @@ func handler(ctx context.Context, request APIGatewayProxyRequest) (*events.APIGa
 	}, nil
 }
 
+// clientFromEnv builds a client for the CLI from the NETLIFY_AUTH_TOKEN,
+// NETLIFY_SITE_ID and NETLIFY_API_URL environment variables.
+func clientFromEnv(siteID string, region string) Client {
+	if siteID == "" {
+		siteID = os.Getenv("NETLIFY_SITE_ID")
+	}
+
+	return Client{
+		APIURL:      os.Getenv("NETLIFY_API_URL"),
+		Consistency: ConsistencyModeStrong,
+		Region:      region,
+		SiteID:      siteID,
+		Token:       os.Getenv("NETLIFY_AUTH_TOKEN"),
+	}
+}
+
+func runMigrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	from := flags.String("from", "", "source store name")
+	to := flags.String("to", "", "destination store name")
+	fromSite := flags.String("from-site", "", "source site ID (defaults to NETLIFY_SITE_ID)")
+	toSite := flags.String("to-site", "", "destination site ID (defaults to NETLIFY_SITE_ID)")
+	fromRegion := flags.String("from-region", "", "source region")
+	toRegion := flags.String("to-region", "", "destination region")
+	prefix := flags.String("prefix", "", "only copy keys starting with this prefix")
+	replacePrefix := flags.String("replace-prefix", "", "replace -prefix with this value in destination keys")
+	checkpointFile := flags.String("checkpoint-file", "", "file used to record progress and resume")
+	flags.Parse(args)
+
+	if *from == "" || *to == "" {
+		return fmt.Errorf("migrate requires -from and -to")
+	}
+
+	source, err := NewStore(*from, clientFromEnv(*fromSite, *fromRegion))
+	if err != nil {
+		return err
+	}
+
+	destination, err := NewStore(*to, clientFromEnv(*toSite, *toRegion))
+	if err != nil {
+		return err
+	}
+
+	options := &MigrateOptions{Prefix: *prefix}
+
+	if *replacePrefix != "" {
+		options.TransformKey = func(key string) (string, error) {
+			return *replacePrefix + strings.TrimPrefix(key, *prefix), nil
+		}
+	}
+
+	if *checkpointFile != "" {
+		checkpoint, err := os.ReadFile(*checkpointFile)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		options.Checkpoint = strings.TrimSpace(string(checkpoint))
+	}
+
+	options.Progress = func(progress MigrateProgress) {
+		fmt.Fprintf(os.Stderr, "[%d/%d] %s -> %s\n", progress.Copied+progress.Skipped, progress.Total, progress.Key, progress.DestinationKey)
+
+		if *checkpointFile != "" {
+			err := os.WriteFile(*checkpointFile, []byte(progress.Key), 0o644)
+			if err != nil {
+				log.Printf("writing checkpoint: %v", err)
+			}
+		}
+	}
+
+	result, err := Migrate(source, destination, options)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("copied %d blobs, skipped %d\n", result.Copied, result.Skipped)
+	return nil
+}
+
+func runChunksGC(args []string) error {
+	flags := flag.NewFlagSet("chunks-gc", flag.ExitOnError)
+	name := flags.String("store", "", "store name")
+	site := flags.String("site", "", "site ID (defaults to NETLIFY_SITE_ID)")
+	region := flags.String("region", "", "region")
+	grace := flags.Duration("grace", 24*time.Hour, "keep uploads younger than this")
+	flags.Parse(args)
+
+	if *name == "" {
+		return fmt.Errorf("chunks-gc requires -store")
+	}
+
+	store, err := NewStore(*name, clientFromEnv(*site, *region))
+	if err != nil {
+		return err
+	}
+
+	result, err := NewChunkedStore(store, 0).GarbageCollect(context.Background(), *grace)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("deleted %d parts from %d uploads\n", result.DeletedParts, result.DeletedUploads)
+	return nil
+}
+
+func runContentGC(args []string) error {
+	flags := flag.NewFlagSet("content-gc", flag.ExitOnError)
+	name := flags.String("store", "", "store name")
+	site := flags.String("site", "", "site ID (defaults to NETLIFY_SITE_ID)")
+	region := flags.String("region", "", "region")
+	grace := flags.Duration("grace", 24*time.Hour, "keep content modified more recently than this, and never less than twice the content refresh interval")
+	flags.Parse(args)
+
+	if *name == "" {
+		return fmt.Errorf("content-gc requires -store")
+	}
+
+	store, err := NewStore(*name, clientFromEnv(*site, *region))
+	if err != nil {
+		return err
+	}
+
+	result, err := NewContentAddressedStore(store).GarbageCollect(context.Background(), *grace)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("deleted %d unreferenced blobs, %d still referenced\n", result.Deleted, result.Referenced)
+	return nil
+}
+
+func runSweep(args []string) error {
+	flags := flag.NewFlagSet("sweep", flag.ExitOnError)
+	name := flags.String("store", "", "store name")
+	site := flags.String("site", "", "site ID (defaults to NETLIFY_SITE_ID)")
+	region := flags.String("region", "", "region")
+	prefix := flags.String("prefix", "", "only sweep keys starting with this prefix")
+	batchSize := flags.Int("batch-size", 100, "number of expired keys deleted at a time")
+	flags.Parse(args)
+
+	if *name == "" {
+		return fmt.Errorf("sweep requires -store")
+	}
+
+	store, err := NewStore(*name, clientFromEnv(*site, *region))
+	if err != nil {
+		return err
+	}
+
+	result, err := store.SweepExpired(context.Background(), &SweepOptions{
+		Prefix:    *prefix,
+		BatchSize: *batchSize,
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("deleted %d expired keys out of %d\n", result.Deleted, result.Scanned)
+	return nil
+}
+
+func runIndexRebuild(args []string) error {
+	flags := flag.NewFlagSet("index-rebuild", flag.ExitOnError)
+	name := flags.String("store", "", "store name")
+	site := flags.String("site", "", "site ID (defaults to NETLIFY_SITE_ID)")
+	region := flags.String("region", "", "region")
+	fields := flags.String("fields", "", "comma-separated metadata fields to index")
+	flags.Parse(args)
+
+	if *name == "" || *fields == "" {
+		return fmt.Errorf("index-rebuild requires -store and -fields")
+	}
+
+	store, err := NewStore(*name, clientFromEnv(*site, *region))
+	if err != nil {
+		return err
+	}
+
+	index := NewIndexedStore(store, strings.Split(*fields, ",")...)
+	result, err := index.Rebuild(context.Background(), nil)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("indexed %d keys, added %d entries, removed %d\n", result.Scanned, result.Added, result.Removed)
+	return nil
+}
+
+func runStats(args []string) error {
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+	name := flags.String("store", "", "store name")
+	site := flags.String("site", "", "site ID (defaults to NETLIFY_SITE_ID)")
+	region := flags.String("region", "", "region")
+	prefix := flags.String("prefix", "", "only report keys starting with this prefix")
+	top := flags.Int("top", 10, "number of largest keys to report")
+	depth := flags.Int("depth", 1, "number of key segments to group prefixes by")
+	format := flags.String("format", "table", "output format, table or json")
+	flags.Parse(args)
+
+	if *name == "" {
+		return fmt.Errorf("stats requires -store")
+	}
+	if *format != "table" && *format != "json" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	store, err := NewStore(*name, clientFromEnv(*site, *region))
+	if err != nil {
+		return err
+	}
+
+	stats, err := store.Stats(context.Background(), &StatsOptions{
+		Prefix:      *prefix,
+		TopKeys:     *top,
+		PrefixDepth: *depth,
+	})
+	if err != nil {
+		return err
+	}
+
+	if *format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(stats)
+	}
+
+	return writeStatsTable(os.Stdout, stats)
+}
+
+// writeStatsTable prints a stats report as aligned tables.
+func writeStatsTable(out io.Writer, stats *StoreStats) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "objects\t%d\n", stats.Objects)
+	fmt.Fprintf(w, "bytes\t%d (%s)\n", stats.Bytes, formatBytes(stats.Bytes))
+
+	fmt.Fprintf(w, "\nSIZE\tOBJECTS\tBYTES\n")
+	for _, bucket := range stats.Histogram {
+		label := fmt.Sprintf("<= %s", formatBytes(bucket.Max))
+		if bucket.Max < 0 {
+			label = fmt.Sprintf("> %s", formatBytes(bucket.Min-1))
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\n", label, bucket.Objects, formatBytes(bucket.Bytes))
+	}
+
+	fmt.Fprintf(w, "\nLARGEST\tSIZE\n")
+	for _, blob := range stats.Largest {
+		fmt.Fprintf(w, "%s\t%s\n", blob.Key, formatBytes(blob.Size))
+	}
+
+	fmt.Fprintf(w, "\nPREFIX\tOBJECTS\tBYTES\n")
+	for _, prefix := range stats.Prefixes {
+		label := prefix.Prefix
+		if label == "" {
+			label = "(root)"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\n", label, prefix.Objects, formatBytes(prefix.Bytes))
+	}
+
+	return w.Flush()
+}
+
+// runCLI dispatches command line invocations. The binary only runs as a
+// Lambda handler when started without arguments.
+func runCLI(args []string) error {
+	switch args[0] {
+	case "chunks-gc":
+		return runChunksGC(args[1:])
+	case "content-gc":
+		return runContentGC(args[1:])
+	case "index-rebuild":
+		return runIndexRebuild(args[1:])
+	case "migrate":
+		return runMigrate(args[1:])
+	case "stats":
+		return runStats(args[1:])
+	case "sweep":
+		return runSweep(args[1:])
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		err := runCLI(os.Args[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	lambda.Start(handler)
 }
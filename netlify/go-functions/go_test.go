@@ -0,0 +1,1557 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// countingClient returns a client for the memory backend that counts the
+// precondition failures it sees. Reads are slowed down so that concurrent
+// writers see the same value and conflict.
+func countingClient(m *MemoryBackend, failures *int64) Client {
+	client := m.Client("site")
+	fetch := client.Fetch
+	client.Fetch = func(url string, req *http.Request) (*http.Response, error) {
+		res, err := fetch(url, req)
+		if req.Method == string(HTTPMethodGet) {
+			time.Sleep(time.Millisecond)
+		}
+		if err == nil && res.StatusCode == 412 {
+			atomic.AddInt64(failures, 1)
+		}
+		return res, err
+	}
+	return client
+}
+
+// contextClient returns a client for the memory backend that fails
+// requests whose context is already done, as a network client would.
+func contextClient(m *MemoryBackend) Client {
+	client := m.Client("site")
+	client.Fetch = func(url string, req *http.Request) (*http.Response, error) {
+		if err := req.Context().Err(); err != nil {
+			return nil, err
+		}
+		return m.Fetch(url, req)
+	}
+	return client
+}
+
+func TestIncrContention(t *testing.T) {
+	var failures int64
+	store, err := NewStore("counters", countingClient(NewMemoryBackend(), &failures))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const workers, increments = 16, 10
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < increments; i++ {
+				_, err := store.Incr(context.Background(), "hits", 1)
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	value, err := store.Incr(context.Background(), "hits", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != workers*increments {
+		t.Fatalf("counter is %d, want %d", value, workers*increments)
+	}
+	if atomic.LoadInt64(&failures) == 0 {
+		t.Fatal("expected conflicting writes to be retried")
+	}
+}
+
+func TestUpdateContention(t *testing.T) {
+	var failures int64
+	store, err := NewStore("lists", countingClient(NewMemoryBackend(), &failures))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const workers = 24
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			_, err := store.Update(context.Background(), "list", func(old []byte) ([]byte, error) {
+				return append(old, []byte(strconv.Itoa(w%10))...), nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	value, err := store.Get("list")
+	if err != nil || value == nil {
+		t.Fatal(value, err)
+	}
+	data, _ := io.ReadAll(value)
+	if len(data) != workers {
+		t.Fatalf("got %d appends, want %d", len(data), workers)
+	}
+	if atomic.LoadInt64(&failures) == 0 {
+		t.Fatal("expected conflicting writes to be retried")
+	}
+}
+
+func FuzzKeyRoundTrip(f *testing.F) {
+	for _, seed := range []string{
+		"plain",
+		"with space",
+		"question?mark=1",
+		"hash#fragment",
+		"ünïcødé/日本語",
+		".",
+		"..",
+		"a/./b",
+		"a/../b",
+		"%2E%2E",
+		"a/%2E%2E/b",
+		"%2Fleading-escaped-slash",
+		"100%",
+		"a//b",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, key string) {
+		// Listings are JSON, which cannot carry invalid UTF-8.
+		if !utf8.ValidString(key) {
+			t.Skip()
+		}
+
+		for _, encoding := range []KeyEncoding{nil, HexKeyEncoding{}} {
+			store, err := NewStore("fuzz", NewMemoryBackend().Client("site"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			store.KeyEncoding = encoding
+
+			if store.checkKey(key) != nil {
+				continue
+			}
+
+			err = store.Set(key, strings.NewReader(key), nil)
+			if err != nil {
+				t.Fatalf("setting %q: %v", key, err)
+			}
+
+			value, err := store.Get(key)
+			if err != nil || value == nil {
+				t.Fatalf("getting %q: %v, %v", key, value, err)
+			}
+			data, err := io.ReadAll(value)
+			if err != nil || string(data) != key {
+				t.Fatalf("getting %q returned %q, %v", key, data, err)
+			}
+
+			listing, err := store.List(nil)
+			if err != nil || len(listing.Blobs) != 1 || listing.Blobs[0].Key != key {
+				t.Fatalf("listing %q returned %+v, %v", key, listing, err)
+			}
+
+			listing, err = store.List(&ListOptions{Prefix: key})
+			if err != nil || len(listing.Blobs) != 1 || listing.Blobs[0].Key != key {
+				t.Fatalf("listing prefix %q returned %+v, %v", key, listing, err)
+			}
+		}
+	})
+}
+
+func TestCacheRevalidationExpiry(t *testing.T) {
+	store, err := NewStore("cached", NewMemoryBackend().Client("site"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Cache = NewCache(CacheOptions{MaxBytes: 1 << 20, MaxEntries: 16})
+
+	err = store.Set("token", strings.NewReader("secret"), &SetOptions{TTL: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := store.Get("token")
+	if err != nil || value == nil {
+		t.Fatal(value, err)
+	}
+
+	time.Sleep(40 * time.Millisecond)
+
+	value, err = store.Get("token")
+	if err != nil || value != nil {
+		t.Fatalf("expired key read through the cache returned %v, %v", value, err)
+	}
+}
+
+func TestContentGCKeepsContentReusedDuringCollection(t *testing.T) {
+	memory := NewMemoryBackend()
+	client := memory.Client("site")
+
+	var cas *ContentAddressedStore
+	var once sync.Once
+	fetch := client.Fetch
+	client.Fetch = func(url string, req *http.Request) (*http.Response, error) {
+		res, err := fetch(url, req)
+		// Once the collection has listed the store, another writer stores
+		// the same content under a new key.
+		if req.Method == string(HTTPMethodGet) && req.URL.Path == "/site/cas" {
+			once.Do(func() {
+				err := cas.Set("second", strings.NewReader("shared"), nil)
+				if err != nil {
+					t.Error(err)
+				}
+			})
+		}
+		return res, err
+	}
+
+	store, err := NewStore("cas", client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cas = NewContentAddressedStore(store)
+	cas.RefreshAfter = time.Millisecond
+
+	err = cas.Set("first", strings.NewReader("shared"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cas.Delete("first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Let the content age past the grace period.
+	time.Sleep(10 * time.Millisecond)
+
+	result, err := cas.GarbageCollect(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Deleted != 0 {
+		t.Fatalf("collection deleted %d blobs, want 0", result.Deleted)
+	}
+
+	value, err := cas.Get("second")
+	if err != nil || value == nil {
+		t.Fatal(value, err)
+	}
+}
+
+func TestChunkedStoreDefaultsChunkSize(t *testing.T) {
+	store, err := NewStore("chunked", NewMemoryBackend().Client("site"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunked := &ChunkedStore{Store: store}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- chunked.Set("file", strings.NewReader("contents"), nil)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Set did not finish with a zero ChunkSize")
+	}
+
+	manifest, err := chunked.GetManifest("file")
+	if err != nil || manifest == nil {
+		t.Fatal(manifest, err)
+	}
+	if manifest.ChunkSize != DEFAULT_CHUNK_SIZE || len(manifest.Chunks) != 1 {
+		t.Fatalf("got manifest %+v", manifest)
+	}
+}
+
+func TestDeleteRejectsEmptyKey(t *testing.T) {
+	memory := NewMemoryBackend()
+	client := memory.Client("site")
+
+	requests := 0
+	fetch := client.Fetch
+	client.Fetch = func(url string, req *http.Request) (*http.Response, error) {
+		requests++
+		return fetch(url, req)
+	}
+
+	store, err := NewStore("store", client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if store.Delete("") == nil {
+		t.Fatal("deleting an empty key succeeded")
+	}
+	if requests != 0 {
+		t.Fatalf("deleting an empty key made %d requests", requests)
+	}
+}
+
+func TestSweepKeepsKeysRewrittenAfterInspection(t *testing.T) {
+	memory := NewMemoryBackend()
+	writer, err := NewStore("sessions", memory.Client("site"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := memory.Client("site")
+	fetch := client.Fetch
+	client.Fetch = func(url string, req *http.Request) (*http.Response, error) {
+		res, err := fetch(url, req)
+		// The key is written again right after the sweep has found it
+		// expired.
+		if req.Method == string(HTTPMethodHead) {
+			err := writer.Set("session", strings.NewReader("renewed"), nil)
+			if err != nil {
+				t.Error(err)
+			}
+		}
+		return res, err
+	}
+
+	sweeper, err := NewStore("sessions", client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = writer.Set("session", strings.NewReader("old"), &SetOptions{ExpiresAt: time.Now().Add(-time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := sweeper.SweepExpired(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Scanned != 1 || result.Deleted != 0 {
+		t.Fatalf("got %+v, want the rewritten key to be kept", result)
+	}
+
+	value, err := writer.Get("session")
+	if err != nil || value == nil {
+		t.Fatal(value, err)
+	}
+}
+
+func TestQueueAckKeepsReclaimedJob(t *testing.T) {
+	memory := NewMemoryBackend()
+
+	other, err := NewStore("jobs", memory.Client("site"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rival := NewQueue(other)
+	rival.VisibilityTimeout = time.Minute
+
+	var reclaimed *Job
+	client := memory.Client("site")
+	fetch := client.Fetch
+	client.Fetch = func(url string, req *http.Request) (*http.Response, error) {
+		res, err := fetch(url, req)
+		// Another worker reclaims the job between the claim check and the
+		// delete.
+		if req.Method == string(HTTPMethodHead) && reclaimed == nil {
+			reclaimed, err = rival.Claim(context.Background())
+			if err != nil || reclaimed == nil {
+				t.Error(reclaimed, err)
+			}
+		}
+		return res, err
+	}
+
+	store, err := NewStore("jobs", client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue := NewQueue(store)
+	queue.VisibilityTimeout = time.Millisecond
+
+	_, err = queue.Enqueue(context.Background(), []byte("work"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := queue.Claim(context.Background())
+	if err != nil || job == nil {
+		t.Fatal(job, err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	var preconditionError *BlobsPreconditionError
+	err = queue.Ack(context.Background(), job)
+	if !errors.As(err, &preconditionError) {
+		t.Fatalf("got %v, want a BlobsPreconditionError", err)
+	}
+
+	err = rival.Ack(context.Background(), reclaimed)
+	if err != nil {
+		t.Fatalf("acknowledging the reclaimed job: %v", err)
+	}
+}
+
+func TestSoftDeleteKeepsConcurrentWrite(t *testing.T) {
+	memory := NewMemoryBackend()
+	writer, err := NewStore("docs", memory.Client("site"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := memory.Client("site")
+	fetch := client.Fetch
+	client.Fetch = func(url string, req *http.Request) (*http.Response, error) {
+		res, err := fetch(url, req)
+		// The key is written again once it has been copied to the trash.
+		if req.Method == string(HTTPMethodPut) {
+			err := writer.Set("doc", strings.NewReader("edited"), nil)
+			if err != nil {
+				t.Error(err)
+			}
+		}
+		return res, err
+	}
+
+	store, err := NewStore("docs", client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = writer.Set("doc", strings.NewReader("draft"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var preconditionError *BlobsPreconditionError
+	err = store.SoftDelete("doc")
+	if !errors.As(err, &preconditionError) {
+		t.Fatalf("got %v, want a BlobsPreconditionError", err)
+	}
+
+	value, err := writer.Get("doc")
+	if err != nil || value == nil {
+		t.Fatal(value, err)
+	}
+	data, _ := io.ReadAll(value)
+	if string(data) != "edited" {
+		t.Fatalf("got %q, want the concurrent write", data)
+	}
+}
+
+func TestBatchCancellationReachesRequests(t *testing.T) {
+	client := NewMemoryBackend().Client("site")
+	client.Fetch = func(url string, req *http.Request) (*http.Response, error) {
+		// Requests hang until they are cancelled.
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(5 * time.Second):
+			return nil, errors.New("request was not cancelled")
+		}
+	}
+
+	store, err := NewStore("batch", client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	keys := []string{"a", "b", "c"}
+	items := []BatchSetItem{{Key: "a", Data: []byte("1")}, {Key: "b", Data: []byte("2")}}
+
+	for _, batch := range []func() []error{
+		func() []error {
+			errs := []error{}
+			for _, result := range store.GetMany(ctx, keys, nil) {
+				errs = append(errs, result.Err)
+			}
+			return errs
+		},
+		func() []error {
+			errs := []error{}
+			for _, result := range store.SetMany(ctx, items, nil) {
+				errs = append(errs, result.Err)
+			}
+			return errs
+		},
+		func() []error {
+			results, err := store.DeleteMany(ctx, keys, nil)
+			errs := []error{err}
+			for _, result := range results {
+				errs = append(errs, result.Err)
+			}
+			return errs
+		},
+	} {
+		started := time.Now()
+		errs := batch()
+		if time.Since(started) > time.Second {
+			t.Fatalf("batch took %v after cancellation", time.Since(started))
+		}
+		for _, err := range errs[len(errs)-1:] {
+			if !errors.Is(err, context.Canceled) {
+				t.Fatalf("got %v, want context.Canceled", err)
+			}
+		}
+	}
+}
+
+func TestEncryptedStoreBindsCiphertextToKey(t *testing.T) {
+	store, err := NewStore("secrets", NewMemoryBackend().Client("site"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := NewStaticKeyProvider("k1", make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted := NewEncryptedStore(store, keys)
+	encrypted.SegmentSize = 4
+
+	err = encrypted.Set("alice", strings.NewReader("alice's secret"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := encrypted.Get("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(value)
+	if err != nil || string(data) != "alice's secret" {
+		t.Fatalf("got %q, %v", data, err)
+	}
+
+	// Copy the ciphertext and its envelope to another key.
+	raw, err := store.GetWithMetadata("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Set("mallory", raw.Data, &SetOptions{Metadata: raw.Metadata})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err = encrypted.Get("mallory")
+	if err == nil {
+		_, err = io.ReadAll(value)
+	}
+	if err == nil {
+		t.Fatal("ciphertext moved to another key decrypted without error")
+	}
+}
+
+func TestSubValidatesCombinedKey(t *testing.T) {
+	store, err := NewStore("shared", NewMemoryBackend().Client("site"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	view := store.Sub(strings.Repeat("p", 590) + "/")
+
+	long := strings.Repeat("k", 20)
+	if view.Set(long, strings.NewReader("value"), nil) == nil {
+		t.Fatal("Set accepted a combined key over the length limit")
+	}
+	if _, err := view.Get(long); err == nil {
+		t.Fatal("Get accepted a combined key over the length limit")
+	}
+	if _, err := view.GetMetadata(long); err == nil {
+		t.Fatal("GetMetadata accepted a combined key over the length limit")
+	}
+	if view.Delete(long) == nil {
+		t.Fatal("Delete accepted a combined key over the length limit")
+	}
+	if _, err := view.Get(""); err == nil {
+		t.Fatal("Get accepted an empty key")
+	}
+
+	err = view.Set("key", strings.NewReader("value"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listing, err := view.List(nil)
+	if err != nil || len(listing.Blobs) != 1 || listing.Blobs[0].Key != "key" {
+		t.Fatalf("got %+v, %v", listing, err)
+	}
+}
+
+func TestUpdateCancelledBeforeWrite(t *testing.T) {
+	store, err := NewStore("update", contextClient(NewMemoryBackend()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err = store.Update(ctx, "key", func(old []byte) ([]byte, error) {
+		cancel()
+		return []byte("value"), nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+
+	value, err := store.Get("key")
+	if err != nil || value != nil {
+		t.Fatalf("got %q, %v, want no value", value, err)
+	}
+}
+
+func TestVersionedDeleteArchivesConcurrentWrite(t *testing.T) {
+	memory := NewMemoryBackend()
+	writer, err := NewStore("docs", memory.Client("site"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := memory.Client("site")
+	var once sync.Once
+	fetch := client.Fetch
+	client.Fetch = func(url string, req *http.Request) (*http.Response, error) {
+		res, err := fetch(url, req)
+		// Once the current value has been archived, another writer
+		// replaces it.
+		if req.Method == string(HTTPMethodPut) && strings.Contains(req.URL.Path, ".versions") {
+			once.Do(func() {
+				err := writer.Set("doc", strings.NewReader("second"), nil)
+				if err != nil {
+					t.Error(err)
+				}
+			})
+		}
+		return res, err
+	}
+
+	store, err := NewStore("docs", client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	versioned := NewVersionedStore(store, VersionRetention{})
+
+	err = versioned.Set("doc", strings.NewReader("first"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = versioned.Delete("doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := versioned.Get("doc")
+	if err != nil || value != nil {
+		t.Fatalf("got %v, %v, want the key deleted", value, err)
+	}
+
+	versions, err := versioned.ListVersions("doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	archived := map[string]bool{}
+	for _, version := range versions {
+		entry, err := versioned.GetVersion("doc", version.ID)
+		if err != nil || entry == nil {
+			t.Fatal(entry, err)
+		}
+		data, _ := io.ReadAll(entry.Data)
+		archived[string(data)] = true
+	}
+	if !archived["first"] || !archived["second"] {
+		t.Fatalf("archived values %v, want first and second", archived)
+	}
+}
+
+func TestQueueLiteralUsesDefaults(t *testing.T) {
+	store, err := NewStore("jobs", NewMemoryBackend().Client("site"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue := &Queue{Store: store, Prefix: "queue/", DeadLetterPrefix: "dead/"}
+
+	_, err = queue.Enqueue(context.Background(), []byte("work"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var handlerErr error
+	err = queue.Run(ctx, func(jobCtx context.Context, job *Job) error {
+		handlerErr = jobCtx.Err()
+		cancel()
+		return errors.New("failed")
+	}, &WorkerOptions{RetryDelay: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if handlerErr != nil {
+		t.Fatalf("handler context was already done: %v", handlerErr)
+	}
+
+	dead, err := store.List(&ListOptions{Prefix: "dead/"})
+	if err != nil || len(dead.Blobs) != 0 {
+		t.Fatalf("dead letters %+v, %v, want none after one failure", dead, err)
+	}
+	queued, err := store.List(&ListOptions{Prefix: "queue/"})
+	if err != nil || len(queued.Blobs) != 1 {
+		t.Fatalf("queued jobs %+v, %v, want the failed job", queued, err)
+	}
+}
+
+func TestEnqueueHonoursContext(t *testing.T) {
+	store, err := NewStore("jobs", contextClient(NewMemoryBackend()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = NewQueue(store).Enqueue(ctx, []byte("work"))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+}
+
+func TestEventLogLiteralUsesDefaultSegmentSize(t *testing.T) {
+	store, err := NewStore("events", NewMemoryBackend().Client("site"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := &EventLog{Store: store, Prefix: "log/"}
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		cursor, err := events.Append(ctx, map[string]int{"n": i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cursor.Segment != 0 || cursor.Offset != i {
+			t.Fatalf("event %d was appended at %+v", i, cursor)
+		}
+	}
+
+	entries, _, err := events.Read(ctx, EventCursor{}, 0)
+	if err != nil || len(entries) != 3 {
+		t.Fatalf("read %d entries, %v, want 3", len(entries), err)
+	}
+}
+
+func TestFlushCancellationReachesRequests(t *testing.T) {
+	client := NewMemoryBackend().Client("site")
+	client.Fetch = func(url string, req *http.Request) (*http.Response, error) {
+		// Requests hang until they are cancelled.
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(5 * time.Second):
+			return nil, errors.New("request was not cancelled")
+		}
+	}
+
+	store, err := NewStore("buffered", client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writer := store.Buffered(nil)
+	err = writer.Set("a", []byte("1"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Delete("b")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	err = writer.Flush(ctx)
+	var flushError *FlushError
+	if !errors.As(err, &flushError) || len(flushError.Errors) != 2 {
+		t.Fatalf("got %v, want a FlushError for both keys", err)
+	}
+	for key, err := range flushError.Errors {
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("flushing %q: got %v, want context.Canceled", key, err)
+		}
+	}
+	if writer.Pending() != 2 {
+		t.Fatalf("%d writes pending, want 2", writer.Pending())
+	}
+}
+
+func TestIndexRebuildRepairsLostEntry(t *testing.T) {
+	store, err := NewStore("indexed", NewMemoryBackend().Client("site"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := NewIndexedStore(store, "color")
+
+	err = index.Set("apple", strings.NewReader("fruit"), &SetOptions{Metadata: Metadata{"color": "red"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := index.Query(IndexQuery{Field: "color", Value: "red"})
+	if err != nil || len(keys) != 1 || keys[0] != "apple" {
+		t.Fatalf("got %v, %v, want [apple]", keys, err)
+	}
+
+	// A racing writer removed the entry of the value that won.
+	err = store.Delete(indexEntryKey("color", "red", "apple"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err = index.Query(IndexQuery{Field: "color", Value: "red"})
+	if err != nil || len(keys) != 0 {
+		t.Fatalf("got %v, %v, want no keys", keys, err)
+	}
+
+	_, err = index.Rebuild(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err = index.Query(IndexQuery{Field: "color", Value: "red"})
+	if err != nil || len(keys) != 1 || keys[0] != "apple" {
+		t.Fatalf("after rebuild got %v, %v, want [apple]", keys, err)
+	}
+}
+
+func TestContentSetReusesFreshContent(t *testing.T) {
+	client := NewMemoryBackend().Client("site")
+
+	var contentWrites int64
+	fetch := client.Fetch
+	client.Fetch = func(url string, req *http.Request) (*http.Response, error) {
+		if req.Method == string(HTTPMethodPut) && strings.Contains(req.URL.Path, ".cas") {
+			atomic.AddInt64(&contentWrites, 1)
+		}
+		return fetch(url, req)
+	}
+
+	store, err := NewStore("cas", client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cas := NewContentAddressedStore(store)
+
+	for _, key := range []string{"first", "second"} {
+		err = cas.Set(key, strings.NewReader("shared"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if atomic.LoadInt64(&contentWrites) != 1 {
+		t.Fatalf("content was uploaded %d times, want once", contentWrites)
+	}
+
+	value, err := cas.Get("second")
+	if err != nil || value == nil {
+		t.Fatal(value, err)
+	}
+	data, _ := io.ReadAll(value)
+	if string(data) != "shared" {
+		t.Fatalf("got %q", data)
+	}
+
+	// Unreferenced content is kept while it is within the grace period,
+	// which is raised to twice RefreshAfter.
+	err = cas.Delete("first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cas.Delete("second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := cas.GarbageCollect(context.Background(), 0)
+	if err != nil || result.Deleted != 0 {
+		t.Fatalf("got %+v, %v, want nothing collected", result, err)
+	}
+
+	cas.RefreshAfter = time.Millisecond
+	time.Sleep(10 * time.Millisecond)
+	result, err = cas.GarbageCollect(context.Background(), 0)
+	if err != nil || result.Deleted != 1 {
+		t.Fatalf("got %+v, %v, want the content collected", result, err)
+	}
+}
+
+func TestMigrateCopiesAndResumes(t *testing.T) {
+	source, err := NewStore("source", NewMemoryBackend().Client("old-site"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	destination, err := NewStore("destination", NewMemoryBackend().Client("new-site"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"a/1", "a/2", "a/skip", "b/1"} {
+		err = source.Set(key, strings.NewReader("value of "+key), &SetOptions{Metadata: Metadata{"key": key}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	options := &MigrateOptions{
+		Prefix:     "a/",
+		Checkpoint: "a/1",
+		TransformKey: func(key string) (string, error) {
+			if key == "a/skip" {
+				return "", nil
+			}
+			return "copied/" + key, nil
+		},
+	}
+	result, err := Migrate(source, destination, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Copied != 1 || result.Skipped != 1 || result.Checkpoint != "a/skip" {
+		t.Fatalf("got %+v", result)
+	}
+
+	options.Checkpoint = ""
+	_, err = Migrate(source, destination, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listing, err := destination.List(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{}
+	for _, blob := range listing.Blobs {
+		keys = append(keys, blob.Key)
+	}
+	if strings.Join(keys, ",") != "copied/a/1,copied/a/2" {
+		t.Fatalf("destination holds %v", keys)
+	}
+
+	entry, err := destination.GetWithMetadata("copied/a/2")
+	if err != nil || entry == nil {
+		t.Fatal(entry, err)
+	}
+	data, _ := io.ReadAll(entry.Data)
+	if string(data) != "value of a/2" || entry.Metadata["key"] != "a/2" {
+		t.Fatalf("got %q with metadata %v", data, entry.Metadata)
+	}
+}
+
+func TestSetSendsContentLengthAndProgress(t *testing.T) {
+	client := NewMemoryBackend().Client("site")
+
+	var contentLength int64 = -1
+	fetch := client.Fetch
+	client.Fetch = func(url string, req *http.Request) (*http.Response, error) {
+		if req.Method == string(HTTPMethodPut) {
+			contentLength = req.ContentLength
+		}
+		return fetch(url, req)
+	}
+
+	store, err := NewStore("uploads", client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var written, total int64
+	calls := 0
+	// A MultiReader hides its length, so it has to be buffered.
+	data := io.MultiReader(strings.NewReader("hello, "), strings.NewReader("world"))
+	err = store.Set("greeting", data, &SetOptions{
+		Progress: func(sent int64, size int64) {
+			calls++
+			written, total = sent, size
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if contentLength != 12 {
+		t.Fatalf("sent Content-Length %d, want 12", contentLength)
+	}
+	if calls == 0 || written != 12 || total != 12 {
+		t.Fatalf("progress reported %d of %d over %d calls", written, total, calls)
+	}
+
+	value, err := store.Get("greeting")
+	if err != nil || value == nil {
+		t.Fatal(value, err)
+	}
+	stored, _ := io.ReadAll(value)
+	if string(stored) != "hello, world" {
+		t.Fatalf("got %q", stored)
+	}
+}
+
+func TestDownloadResumesInterruptedRanges(t *testing.T) {
+	client := NewMemoryBackend().Client("site")
+
+	var interrupted int64
+	fetch := client.Fetch
+	client.Fetch = func(url string, req *http.Request) (*http.Response, error) {
+		res, err := fetch(url, req)
+		// The first response for each 16 byte chunk is cut off half way
+		// through, so the rest has to be requested again.
+		start, _ := strconv.Atoi(strings.Split(strings.TrimPrefix(req.Header.Get("range"), "bytes="), "-")[0])
+		if err == nil && res.StatusCode == 206 && start%16 == 0 {
+			atomic.AddInt64(&interrupted, 1)
+			res.Body = io.NopCloser(io.LimitReader(res.Body, 8))
+		}
+		return res, err
+	}
+
+	store, err := NewStore("downloads", client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value := strings.Repeat("0123456789", 10)
+	err = store.Set("file", strings.NewReader(value), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	part, err := store.GetRange("file", 10, 5)
+	if err != nil || part == nil {
+		t.Fatal(part, err)
+	}
+	data, _ := io.ReadAll(part)
+	if string(data) != "01234" {
+		t.Fatalf("range returned %q", data)
+	}
+
+	file, err := os.CreateTemp(t.TempDir(), "download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	state := &DownloadState{}
+	result, err := store.DownloadTo(context.Background(), "file", file, &DownloadOptions{
+		ChunkSize: 16,
+		State:     state,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Size != int64(len(value)) || atomic.LoadInt64(&interrupted) == 0 {
+		t.Fatalf("got %+v after %d interruptions", result, interrupted)
+	}
+
+	downloaded, err := os.ReadFile(file.Name())
+	if err != nil || string(downloaded) != value {
+		t.Fatalf("downloaded %q, %v", downloaded, err)
+	}
+
+	// Resuming against a value that has since changed is refused.
+	err = store.Set("file", strings.NewReader("replaced"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.Done[0] = false
+	_, err = store.DownloadTo(context.Background(), "file", file, &DownloadOptions{State: state})
+	var preconditionError *BlobsPreconditionError
+	if !errors.As(err, &preconditionError) {
+		t.Fatalf("got %v, want a BlobsPreconditionError", err)
+	}
+}
+
+func TestCompressedStoreRoundTrip(t *testing.T) {
+	store, err := NewStore("compressed", NewMemoryBackend().Client("site"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed := NewCompressedStore(store, nil)
+	compressed.MinSize = 64
+
+	value := strings.Repeat("compressible ", 100)
+	err = compressed.Set("large", strings.NewReader(value), &SetOptions{Metadata: Metadata{"owner": "me"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = compressed.Set("small", strings.NewReader("tiny"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Set("plain", strings.NewReader("written directly"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := store.GetMetadata("large")
+	if err != nil || raw == nil {
+		t.Fatal(raw, err)
+	}
+	if raw.Metadata[CODEC_METADATA_KEY] != "gzip" || raw.Size >= int64(len(value)) {
+		t.Fatalf("stored %d bytes with metadata %v", raw.Size, raw.Metadata)
+	}
+
+	entry, err := compressed.GetWithMetadata("large")
+	if err != nil || entry == nil {
+		t.Fatal(entry, err)
+	}
+	data, _ := io.ReadAll(entry.Data)
+	if string(data) != value {
+		t.Fatalf("read back %d bytes, want %d", len(data), len(value))
+	}
+	if _, ok := entry.Metadata[CODEC_METADATA_KEY]; ok || entry.Metadata["owner"] != "me" {
+		t.Fatalf("got metadata %v", entry.Metadata)
+	}
+
+	for key, want := range map[string]string{"small": "tiny", "plain": "written directly"} {
+		value, err := compressed.Get(key)
+		if err != nil || value == nil {
+			t.Fatal(value, err)
+		}
+		data, _ := io.ReadAll(value)
+		if string(data) != want {
+			t.Fatalf("%s: got %q, want %q", key, data, want)
+		}
+	}
+}
+
+type testProfile struct {
+	Name  string
+	Tags  []string
+	Score float64
+}
+
+func TestTypedStoreRoundTrip(t *testing.T) {
+	store, err := NewStore("typed", NewMemoryBackend().Client("site"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	profile := testProfile{Name: "Ada", Tags: []string{"math", "engines"}, Score: 1.5}
+	for name, codec := range map[string]ValueCodec[testProfile]{
+		"json": JSONCodec[testProfile]{},
+		"gob":  GobCodec[testProfile]{},
+	} {
+		typed := NewTypedStore[testProfile](store, codec)
+
+		err = typed.Set(name, profile, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, ok, err := typed.Get(name)
+		if err != nil || !ok {
+			t.Fatalf("%s: got %v, %v", name, ok, err)
+		}
+		if value.Name != profile.Name || strings.Join(value.Tags, ",") != "math,engines" || value.Score != profile.Score {
+			t.Fatalf("%s: read back %+v, want %+v", name, value, profile)
+		}
+
+		_, ok, err = typed.Get("missing")
+		if err != nil || ok {
+			t.Fatalf("%s: missing key returned %v, %v", name, ok, err)
+		}
+	}
+}
+
+func TestTypedStoreUpgradesOldValues(t *testing.T) {
+	store, err := NewStore("typed", NewMemoryBackend().Client("site"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = NewTypedStore[string](store, TextCodec{}).Set("greeting", "hello", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upgraded := NewTypedStore[string](store, TextCodec{})
+	upgraded.SchemaVersion = 1
+	upgraded.Upgrades[0] = func(data []byte) ([]byte, error) {
+		return []byte(strings.ToUpper(string(data))), nil
+	}
+
+	value, ok, err := upgraded.Get("greeting")
+	if err != nil || !ok || value != "HELLO" {
+		t.Fatalf("got %q, %v, %v, want HELLO", value, ok, err)
+	}
+
+	err = upgraded.Set("greeting", "hi", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = NewTypedStore[string](store, TextCodec{}).Get("greeting")
+	if err == nil {
+		t.Fatal("reading a newer schema version succeeded")
+	}
+}
+
+func TestLockExclusionAndFencing(t *testing.T) {
+	store, err := NewStore("locks", NewMemoryBackend().Client("site"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	first, err := NewLock(store, "job", "first", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewLock(store, "job", "second", 20*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acquired, err := first.TryAcquire(ctx)
+	if err != nil || !acquired || first.Token() != 1 {
+		t.Fatalf("first lock: %v, %v, token %d", acquired, err, first.Token())
+	}
+	acquired, err = second.TryAcquire(ctx)
+	if err != nil || acquired {
+		t.Fatalf("second lock taken while held: %v, %v", acquired, err)
+	}
+
+	var timeoutError *LockTimeoutError
+	err = second.Acquire(ctx, 20*time.Millisecond)
+	if !errors.As(err, &timeoutError) {
+		t.Fatalf("got %v, want a LockTimeoutError", err)
+	}
+
+	err = first.Release(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = second.Acquire(ctx, time.Second)
+	if err != nil || second.Token() != 2 {
+		t.Fatalf("second lock: %v, token %d", err, second.Token())
+	}
+
+	// Once the second lease expires, the first holder steals it and the
+	// second can no longer renew.
+	time.Sleep(40 * time.Millisecond)
+	acquired, err = first.TryAcquire(ctx)
+	if err != nil || !acquired || first.Token() != 3 {
+		t.Fatalf("stealing expired lease: %v, %v, token %d", acquired, err, first.Token())
+	}
+
+	var lostError *LockLostError
+	err = second.Renew(ctx)
+	if !errors.As(err, &lostError) {
+		t.Fatalf("got %v, want a LockLostError", err)
+	}
+}
+
+func TestTenantIsolationAndQuota(t *testing.T) {
+	store, err := NewStore("tenants", NewMemoryBackend().Client("site"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenants := NewTenantedStore(store, TenantQuota{MaxObjects: 2})
+
+	a, err := tenants.Tenant("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := tenants.Tenant("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"", ".", "..", "a/b"} {
+		if _, err := tenants.Tenant(id); err == nil {
+			t.Fatalf("tenant ID %q was accepted", id)
+		}
+	}
+
+	err = b.Set("doc", strings.NewReader("secret"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"../b/doc", "x/../../b/doc", "./doc"} {
+		if err := a.Set(key, strings.NewReader("overwrite"), nil); err == nil {
+			t.Fatalf("Set(%q) was accepted", key)
+		}
+		if _, err := a.Get(key); err == nil {
+			t.Fatalf("Get(%q) was accepted", key)
+		}
+		if err := a.Delete(key); err == nil {
+			t.Fatalf("Delete(%q) was accepted", key)
+		}
+	}
+	for _, key := range []string{"doc", "%2E%2E/b/doc", "/b/doc"} {
+		value, err := a.Get(key)
+		if err == nil && value != nil {
+			t.Fatalf("Get(%q) reached another tenant's value", key)
+		}
+	}
+
+	listing, err := a.List(nil)
+	if err != nil || len(listing.Blobs) != 0 {
+		t.Fatalf("tenant a lists %+v, %v", listing, err)
+	}
+	listing, err = b.List(nil)
+	if err != nil || len(listing.Blobs) != 1 || listing.Blobs[0].Key != "doc" {
+		t.Fatalf("tenant b lists %+v, %v", listing, err)
+	}
+
+	for _, key := range []string{"one", "two"} {
+		err = a.Set(key, strings.NewReader("12345"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var quotaError *QuotaExceededError
+	err = a.Set("three", strings.NewReader("12345"), nil)
+	if !errors.As(err, &quotaError) {
+		t.Fatalf("got %v, want a QuotaExceededError", err)
+	}
+
+	usage, err := a.Usage()
+	if err != nil || usage.Objects != 2 || usage.Bytes != 10 {
+		t.Fatalf("usage %+v, %v, want 2 objects and 10 bytes", usage, err)
+	}
+
+	err = a.Delete("one")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.Set("three", strings.NewReader("12345"), nil)
+	if err != nil {
+		t.Fatalf("writing after freeing quota: %v", err)
+	}
+}
+
+func TestStatsTotals(t *testing.T) {
+	memory := NewMemoryBackend()
+	memory.PageSize = 2
+	store, err := NewStore("stats", memory.Client("site"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, size := range map[string]int{"img/a": 2000, "img/b": 10, "docs/c": 100, "top": 5} {
+		err = store.Set(key, strings.NewReader(strings.Repeat("x", size)), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, err := store.Stats(context.Background(), &StatsOptions{TopKeys: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Objects != 4 || stats.Bytes != 2115 {
+		t.Fatalf("got %d objects and %d bytes, want 4 and 2115", stats.Objects, stats.Bytes)
+	}
+	if stats.Histogram[0].Objects != 3 || stats.Histogram[0].Bytes != 115 ||
+		stats.Histogram[1].Objects != 1 || stats.Histogram[1].Bytes != 2000 {
+		t.Fatalf("got histogram %+v", stats.Histogram[:2])
+	}
+	if len(stats.Largest) != 2 || stats.Largest[0].Key != "img/a" || stats.Largest[1].Key != "docs/c" {
+		t.Fatalf("got largest %+v", stats.Largest)
+	}
+
+	prefixes := []string{}
+	for _, prefix := range stats.Prefixes {
+		prefixes = append(prefixes, fmt.Sprintf("%s=%d/%d", prefix.Prefix, prefix.Objects, prefix.Bytes))
+	}
+	if strings.Join(prefixes, " ") != "img/=2/2010 docs/=1/100 =1/5" {
+		t.Fatalf("got prefixes %v", prefixes)
+	}
+
+	scoped, err := store.Stats(context.Background(), &StatsOptions{Prefix: "img/"})
+	if err != nil || scoped.Objects != 2 || scoped.Bytes != 2010 {
+		t.Fatalf("got %+v, %v for the img/ prefix", scoped, err)
+	}
+}
+
+func TestAuditHookFiresOncePerMutation(t *testing.T) {
+	memory := NewMemoryBackend()
+	client := memory.Client("site")
+
+	var mu sync.Mutex
+	events := []AuditEvent{}
+	client.Audit = func(event AuditEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, event)
+	}
+
+	store, err := NewStore("audited", client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.Set("doc", strings.NewReader("hello"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.Get("doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.List(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.Delete("doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 2 {
+		t.Fatalf("got %d events, want one per mutation: %+v", len(events), events)
+	}
+	set, deleted := events[0], events[1]
+	if set.Method != HTTPMethodPut || set.Store != "audited" || set.Key != "doc" ||
+		set.Size != 5 || set.Status != 200 || set.ETag == "" {
+		t.Fatalf("got set event %+v", set)
+	}
+	if deleted.Method != HTTPMethodDelete || deleted.Key != "doc" || deleted.Status != 204 {
+		t.Fatalf("got delete event %+v", deleted)
+	}
+}
+
+func TestBlobAuditSinkWritesEvents(t *testing.T) {
+	memory := NewMemoryBackend()
+
+	// Writing the log must not audit itself, even through an audited
+	// client.
+	auditClient := memory.Client("site")
+	auditClient.Audit = func(event AuditEvent) {
+		t.Errorf("writing the audit log was audited: %+v", event)
+	}
+	auditStore, err := NewStore(AUDIT_STORE_NAME, auditClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := NewBlobAuditSink(auditStore)
+
+	client := memory.Client("site")
+	client.Audit = sink.Record
+	store, err := NewStore("audited", client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"a", "b"} {
+		err = store.Set(key, strings.NewReader(key), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = sink.Flush(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listing, err := auditStore.List(nil)
+	if err != nil || len(listing.Blobs) != 1 {
+		t.Fatalf("audit log holds %+v, %v, want one segment", listing, err)
+	}
+	segment, err := auditStore.Get(listing.Blobs[0].Key)
+	if err != nil || segment == nil {
+		t.Fatal(segment, err)
+	}
+	data, _ := io.ReadAll(segment)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], `"key":"a"`) || !strings.Contains(lines[1], `"key":"b"`) {
+		t.Fatalf("got segment %q", data)
+	}
+}
+
+func TestPolicyDenyOverridesAllowInEitherOrder(t *testing.T) {
+	allow := PolicyRule{Effect: POLICY_EFFECT_ALLOW, Operations: []PolicyOperation{PolicyOperationAll}, Keys: []string{"**"}}
+	deny := PolicyRule{Effect: POLICY_EFFECT_DENY, Operations: []PolicyOperation{PolicyOperationWrite}, Keys: []string{"config/*"}}
+
+	for _, rules := range [][]PolicyRule{{allow, deny}, {deny, allow}} {
+		policy := &Policy{Rules: rules}
+
+		if policy.Allows(PolicyOperationWrite, "config/site") {
+			t.Fatalf("rules %+v allow a denied write", rules)
+		}
+		if !policy.Allows(PolicyOperationRead, "config/site") {
+			t.Fatalf("rules %+v deny a read only the allow rule matches", rules)
+		}
+		if !policy.Allows(PolicyOperationWrite, "config/nested/site") {
+			t.Fatalf("rules %+v deny a write outside the deny glob", rules)
+		}
+	}
+
+	if (&Policy{Rules: []PolicyRule{deny}}).Allows(PolicyOperationRead, "other") {
+		t.Fatal("an operation no allow rule matches was allowed")
+	}
+}
+
+func TestPolicyStoreEnforcesPolicy(t *testing.T) {
+	store, err := NewStore("guarded", NewMemoryBackend().Client("site"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"public/page", "private/secret"} {
+		err = store.Set(key, strings.NewReader(key), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	policy, err := ParsePolicy([]byte(`{"rules": [
+		{"effect": "deny", "operations": ["*"], "keys": ["private/**"]},
+		{"effect": "allow", "operations": ["read", "list"], "keys": ["**"]}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	guarded := NewPolicyStore(store, policy)
+
+	value, err := guarded.Get("public/page")
+	if err != nil || value == nil {
+		t.Fatal(value, err)
+	}
+
+	var deniedError *PolicyDeniedError
+	if _, err := guarded.Get("private/secret"); !errors.As(err, &deniedError) {
+		t.Fatalf("reading a denied key: got %v", err)
+	}
+	if err := guarded.Set("public/page", strings.NewReader("changed"), nil); !errors.As(err, &deniedError) {
+		t.Fatalf("writing without an allow rule: got %v", err)
+	}
+	if err := guarded.Delete("public/page"); !errors.As(err, &deniedError) {
+		t.Fatalf("deleting without an allow rule: got %v", err)
+	}
+
+	listing, err := guarded.List(nil)
+	if err != nil || len(listing.Blobs) != 1 || listing.Blobs[0].Key != "public/page" {
+		t.Fatalf("got listing %+v, %v", listing, err)
+	}
+
+	_, err = ParsePolicy([]byte(`{"rules": [{"effect": "maybe", "operations": ["read"], "keys": ["**"]}]}`))
+	if err == nil {
+		t.Fatal("a rule with an unknown effect was accepted")
+	}
+}
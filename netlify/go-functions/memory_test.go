@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MEMORY_BACKEND_URL is the edge URL used by clients of a MemoryBackend.
+const MEMORY_BACKEND_URL = "http://memory.blobs.invalid"
+
+// MemoryBackend is an in-memory implementation of the blobs edge API. Its
+// Fetch method can be used as a Client's Fetch function to run stores
+// without network access, including conditional writes, ranged reads and
+// paginated listings.
+type MemoryBackend struct {
+	// PageSize is the number of blobs returned per list page. Defaults to
+	// 1000.
+	PageSize int
+
+	mu      sync.Mutex
+	blobs   map[string]*memoryBlob
+	counter int64
+}
+
+type memoryBlob struct {
+	data         []byte
+	metadata     string
+	etag         string
+	lastModified time.Time
+}
+
+// NewMemoryBackend creates an empty in-memory backend.
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		blobs: map[string]*memoryBlob{},
+	}
+}
+
+// Client returns a client that talks to the backend.
+func (m *MemoryBackend) Client(siteID string) Client {
+	return Client{
+		Consistency:     ConsistencyModeStrong,
+		EdgeURL:         MEMORY_BACKEND_URL,
+		Fetch:           m.Fetch,
+		SiteID:          siteID,
+		Token:           "memory",
+		UncachedEdgeURL: MEMORY_BACKEND_URL,
+	}
+}
+
+// Fetch serves a request against the in-memory blobs.
+func (m *MemoryBackend) Fetch(url string, req *http.Request) (*http.Response, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	path := strings.TrimPrefix(req.URL.Path, "/")
+	if strings.HasPrefix(path, "region:") {
+		path = path[strings.Index(path, "/")+1:]
+	}
+
+	segments := strings.SplitN(path, "/", 3)
+	if len(segments) < 2 || segments[1] == "" {
+		return memoryResponse(req, 400, nil, nil), nil
+	}
+
+	store := segments[0] + "/" + segments[1]
+	if len(segments) == 2 || segments[2] == "" {
+		return m.list(req, store)
+	}
+
+	id := store + "/" + segments[2]
+	blob := m.blobs[id]
+
+	switch HTTPMethod(req.Method) {
+	case HTTPMethodPut:
+		if req.Header.Get("if-none-match") == "*" && blob != nil {
+			return memoryResponse(req, 412, nil, nil), nil
+		}
+		if match := req.Header.Get("if-match"); match != "" && (blob == nil || blob.etag != match) {
+			return memoryResponse(req, 412, nil, nil), nil
+		}
+
+		data := []byte{}
+		if req.Body != nil {
+			var err error
+			data, err = io.ReadAll(req.Body)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		m.counter++
+		blob = &memoryBlob{
+			data:         data,
+			metadata:     req.Header.Get(METADATA_HEADER_INTERNAL),
+			etag:         fmt.Sprintf(`"%d"`, m.counter),
+			lastModified: time.Now(),
+		}
+		m.blobs[id] = blob
+		return memoryResponse(req, 200, http.Header{"Etag": {blob.etag}}, nil), nil
+
+	case HTTPMethodDelete:
+		if match := req.Header.Get("if-match"); match != "" && blob != nil && blob.etag != match {
+			return memoryResponse(req, 412, nil, nil), nil
+		}
+		delete(m.blobs, id)
+		return memoryResponse(req, 204, nil, nil), nil
+
+	case HTTPMethodGet, HTTPMethodHead:
+		if blob == nil {
+			return memoryResponse(req, 404, nil, nil), nil
+		}
+
+		header := http.Header{}
+		header.Set("etag", blob.etag)
+		if blob.metadata != "" {
+			header.Set(METADATA_HEADER_INTERNAL, blob.metadata)
+		}
+
+		if match := req.Header.Get("if-match"); match != "" && match != blob.etag {
+			return memoryResponse(req, 412, header, nil), nil
+		}
+		if match := req.Header.Get("if-none-match"); match != "" && match == blob.etag {
+			return memoryResponse(req, 304, header, nil), nil
+		}
+
+		data := blob.data
+		status := 200
+		if spec := req.Header.Get("range"); spec != "" {
+			start, end, ok := parseByteRange(spec, int64(len(data)))
+			if !ok {
+				return memoryResponse(req, 416, header, nil), nil
+			}
+			header.Set("content-range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+			data = data[start : end+1]
+			status = 206
+		}
+
+		return memoryResponse(req, status, header, data), nil
+	}
+
+	return memoryResponse(req, 405, nil, nil), nil
+}
+
+func (m *MemoryBackend) list(req *http.Request, store string) (*http.Response, error) {
+	query := req.URL.Query()
+	prefix := query.Get("prefix")
+	directories := query.Get("directories") == "true"
+
+	keys := []string{}
+	seenDirectories := map[string]bool{}
+	for id := range m.blobs {
+		if !strings.HasPrefix(id, store+"/") {
+			continue
+		}
+		key := strings.TrimPrefix(id, store+"/")
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	page := ListResponse{
+		Blobs:       []ListResponseBlob{},
+		Directories: []string{},
+	}
+
+	pageSize := m.PageSize
+	if pageSize <= 0 {
+		pageSize = 1000
+	}
+
+	cursor := query.Get("cursor")
+	for _, key := range keys {
+		if cursor != "" && key <= cursor {
+			continue
+		}
+
+		if directories {
+			if slash := strings.Index(key[len(prefix):], "/"); slash >= 0 {
+				directory := key[:len(prefix)+slash]
+				if !seenDirectories[directory] {
+					seenDirectories[directory] = true
+					page.Directories = append(page.Directories, directory)
+				}
+				continue
+			}
+		}
+
+		if len(page.Blobs) == pageSize {
+			page.NextCursor = page.Blobs[len(page.Blobs)-1].Key
+			break
+		}
+
+		blob := m.blobs[store+"/"+key]
+		page.Blobs = append(page.Blobs, ListResponseBlob{
+			ETag:         blob.etag,
+			Key:          key,
+			LastModified: blob.lastModified.UTC().Format(time.RFC3339),
+			Size:         int64(len(blob.data)),
+		})
+	}
+
+	payload, err := json.Marshal(page)
+	if err != nil {
+		return nil, err
+	}
+
+	return memoryResponse(req, 200, http.Header{"Content-Type": {"application/json"}}, payload), nil
+}
+
+// parseByteRange parses a single "bytes=start-end" range against a value of
+// the given size.
+func parseByteRange(spec string, size int64) (int64, int64, bool) {
+	bounds := strings.SplitN(strings.TrimPrefix(spec, "bytes="), "-", 2)
+	if len(bounds) != 2 {
+		return 0, 0, false
+	}
+
+	start, err := strconv.ParseInt(bounds[0], 10, 64)
+	if err != nil || start >= size {
+		return 0, 0, false
+	}
+
+	end := size - 1
+	if bounds[1] != "" {
+		end, err = strconv.ParseInt(bounds[1], 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false
+		}
+		if end > size-1 {
+			end = size - 1
+		}
+	}
+
+	return start, end, true
+}
+
+func memoryResponse(req *http.Request, status int, header http.Header, data []byte) *http.Response {
+	if header == nil {
+		header = http.Header{}
+	}
+
+	body := data
+	if req.Method == string(HTTPMethodHead) {
+		body = nil
+	}
+
+	return &http.Response{
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(data)),
+		Header:        header,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Request:       req,
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+	}
+}